@@ -7,6 +7,9 @@ package mawt
 // to the fadecandy server interface
 
 import (
+	"image/color"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/karlmutch/errors"
@@ -19,8 +22,17 @@ import (
 type statusSink struct {
 	statusC chan *model.PortalStatus
 	portal  animationModel.Portal
+
+	health model.HealthState
+	lost   []animationModel.ChannelData // Frame buffers for the signal lost pattern
+	sync.Mutex
 }
 
+const (
+	// The time taken for the signal lost pattern to sweep across every channel
+	signalLostPeriod = time.Duration(4 * time.Second)
+)
+
 func NewSink() (sink *statusSink) {
 	return &statusSink{
 		statusC: make(chan *model.PortalStatus),
@@ -33,6 +45,54 @@ func (sink *statusSink) UpdateStatus(status *model.Status) (err errors.Error) {
 	return nil
 }
 
+// UpdateHealth is used to inform the sink of the liveness of the home portal
+//
+func (sink *statusSink) UpdateHealth(health model.HealthState) {
+	sink.Lock()
+	sink.health = health
+	sink.Unlock()
+}
+
 func (sink *statusSink) GetFrame(tm time.Time) []animationModel.ChannelData {
-	return sink.portal.GetFrame(tm)
+	frame := sink.portal.GetFrame(tm)
+
+	sink.Lock()
+	defer sink.Unlock()
+
+	if sink.health != model.HealthOffline {
+		return frame
+	}
+	return sink.signalLostFrame(tm, frame)
+}
+
+// signalLostFrame renders a dim amber band that slowly sweeps across the channels,
+// which is used while the home portal cannot be reached.  The portal frame is
+// used only to size the buffers
+//
+func (sink *statusSink) signalLostFrame(tm time.Time, frame []animationModel.ChannelData) []animationModel.ChannelData {
+
+	if len(sink.lost) != len(frame) {
+		sink.lost = make([]animationModel.ChannelData, len(frame))
+	}
+
+	phase := float64(tm.UnixNano()%int64(signalLostPeriod)) / float64(signalLostPeriod)
+
+	for i, channel := range frame {
+		if len(sink.lost[i].Data) != len(channel.Data) {
+			sink.lost[i].Data = make([]color.RGBA, len(channel.Data))
+		}
+		sink.lost[i].ChannelNum = channel.ChannelNum
+
+		level := math.Pow(0.5*(1.0+math.Cos(2.0*math.Pi*(phase-float64(i)/float64(len(frame))))), 4) * 0.3
+		c := color.RGBA{
+			R: uint8(255 * level),
+			G: uint8(96 * level),
+			B: 0,
+			A: 255,
+		}
+		for pixel := range sink.lost[i].Data {
+			sink.lost[i].Data[pixel] = c
+		}
+	}
+	return sink.lost
 }
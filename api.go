@@ -0,0 +1,242 @@
+package mawt
+
+// This module implements an HTTP API, using JSON, that allows operators to
+// inspect and control a running Gateway.  It is served on its own listener,
+// separate from the debugging listener used by pprof and the LED viewer.
+//
+// The following requests are supported
+//
+//	GET  /api/v1/status          everything below in a single document
+//	GET  /api/v1/portals         the last status and health of each tecthulhu
+//	POST /api/v1/portals/status  inject a status, {"url": "...", "status": {...}}
+//	GET  /api/v1/home            the home portal and the policy used to select it
+//	POST /api/v1/home            change the home portal, {"url": "...", "policy": "..."}
+//	GET  /api/v1/leds            the animation sequence and fadecandy servers
+//	POST /api/v1/leds/force      force a faction animation, {"faction": "E"}, "" to stop
+//	POST /api/v1/leds/blank      turn off, or restore, the LEDs, {"blank": true}
+//	GET  /api/v1/audio           the state of the audio output
+//	POST /api/v1/audio/mute      silence, or restore, the audio, {"muted": true}
+//	GET  /api/v1/subscribers     the queue statistics for each fan-out subscriber
+//
+// Injected statuses use the canonical status, see model/portal.go, and are
+// shown until the tecthulhu is next checked.  When the home portal is given
+// without a policy the fixed policy is used.
+//
+// When a token is configured every request must carry it using an
+// "Authorization: Bearer <token>" header.  Successful actions are answered
+// with 204 No Content, failures with a JSON document holding an error.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/TeamNorCal/mawt/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	// The largest request body accepted by the API
+	apiMaxBody = 1 << 16
+)
+
+// APIStatus is the document returned for /api/v1/status
+//
+type APIStatus struct {
+	Home        APIHome           `json:"home"`
+	Portals     []PortalState     `json:"portals"`
+	LEDs        LEDStatus         `json:"leds"`
+	Audio       AudioStatus       `json:"audio"`
+	Subscribers []SubscriberStats `json:"subscribers"`
+}
+
+// APIHome describes the home portal and the policy used to select it
+//
+type APIHome struct {
+	URL    string     `json:"url"`
+	Policy HomePolicy `json:"policy"`
+}
+
+type apiInject struct {
+	URL    string        `json:"url"`
+	Status *model.Status `json:"status"`
+}
+
+type apiForce struct {
+	Faction string `json:"faction"`
+}
+
+type apiBlank struct {
+	Blank bool `json:"blank"`
+}
+
+type apiMute struct {
+	Muted bool `json:"muted"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// API serves the control and status requests for a Gateway
+//
+type API struct {
+	gw    *Gateway
+	token string
+	mux   *http.ServeMux
+}
+
+// NewAPI creates the handler for the API, an empty token allows requests
+// without authorization
+//
+func NewAPI(gw *Gateway, token string) (api *API) {
+	api = &API{
+		gw:    gw,
+		token: token,
+		mux:   http.NewServeMux(),
+	}
+
+	api.mux.HandleFunc("/api/v1/status", api.get(func() interface{} { return api.status() }))
+	api.mux.HandleFunc("/api/v1/portals", api.get(func() interface{} { return gw.Portals() }))
+	api.mux.HandleFunc("/api/v1/home", api.handleHome)
+	api.mux.HandleFunc("/api/v1/leds", api.get(func() interface{} { return gw.LEDs().Status() }))
+	api.mux.HandleFunc("/api/v1/audio", api.get(func() interface{} { return gw.Audio().Status() }))
+	api.mux.HandleFunc("/api/v1/subscribers", api.get(func() interface{} { return gw.FanOut().Stats() }))
+
+	api.mux.HandleFunc("/api/v1/portals/status", api.post(func(r *http.Request) (err errors.Error) {
+		req := &apiInject{}
+		if err = decodeAPI(r, req); err != nil {
+			return err
+		}
+		return gw.InjectStatus(req.URL, req.Status)
+	}))
+	api.mux.HandleFunc("/api/v1/leds/force", api.post(func(r *http.Request) (err errors.Error) {
+		req := &apiForce{}
+		if err = decodeAPI(r, req); err != nil {
+			return err
+		}
+		return gw.LEDs().Force(req.Faction)
+	}))
+	api.mux.HandleFunc("/api/v1/leds/blank", api.post(func(r *http.Request) (err errors.Error) {
+		req := &apiBlank{}
+		if err = decodeAPI(r, req); err != nil {
+			return err
+		}
+		return gw.LEDs().Blank(req.Blank)
+	}))
+	api.mux.HandleFunc("/api/v1/audio/mute", api.post(func(r *http.Request) (err errors.Error) {
+		req := &apiMute{}
+		if err = decodeAPI(r, req); err != nil {
+			return err
+		}
+		gw.Audio().Mute(req.Muted)
+		return nil
+	}))
+
+	return api
+}
+
+// ServeHTTP checks the authorization of a request before passing it to its handler
+//
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(api.token) != 0 {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(api.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mawt"`)
+			writeAPI(w, http.StatusUnauthorized, &apiError{Error: "a valid token is needed"})
+			return
+		}
+	}
+	api.mux.ServeHTTP(w, r)
+}
+
+func (api *API) status() (status *APIStatus) {
+	url, policy := api.gw.Home()
+	return &APIStatus{
+		Home:        APIHome{URL: url, Policy: policy},
+		Portals:     api.gw.Portals(),
+		LEDs:        api.gw.LEDs().Status(),
+		Audio:       api.gw.Audio().Status(),
+		Subscribers: api.gw.FanOut().Stats(),
+	}
+}
+
+func (api *API) handleHome(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		url, policy := api.gw.Home()
+		writeAPI(w, http.StatusOK, &APIHome{URL: url, Policy: policy})
+	case http.MethodPost:
+		req := &APIHome{}
+		err := decodeAPI(r, req)
+		if err == nil {
+			if len(req.Policy) == 0 {
+				req.Policy = HomeFixed
+			}
+			err = api.gw.FanOut().SetHomePolicy(req.Policy, req.URL)
+		}
+		if err != nil {
+			writeAPI(w, http.StatusBadRequest, &apiError{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAPI(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+	}
+}
+
+// get returns a handler for a request that reads the document built by the function
+//
+func (api *API) get(doc func() interface{}) (handler http.HandlerFunc) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeAPI(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+			return
+		}
+		writeAPI(w, http.StatusOK, doc())
+	}
+}
+
+// post returns a handler for a request that performs an operator action
+//
+func (api *API) post(action func(r *http.Request) errors.Error) (handler http.HandlerFunc) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeAPI(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+			return
+		}
+		if err := action(r); err != nil {
+			writeAPI(w, http.StatusBadRequest, &apiError{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// decodeAPI reads the JSON body of a request
+//
+func decodeAPI(r *http.Request, req interface{}) (err errors.Error) {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, apiMaxBody))
+	if errGo := decoder.Decode(req); errGo != nil {
+		return errors.Wrap(errGo, "invalid request body").With("path", r.URL.Path).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func writeAPI(w http.ResponseWriter, code int, doc interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(doc)
+}
@@ -3,9 +3,11 @@ package mawt
 // This module is responsible for driving the audio
 // output of this project.
 //
-// The audio portion of this project requires that
-// files be converted to aiff files in 2 channel,
-// 44100 Hz, pcm_s16le (16 Bit Signed Little Endian).
+// The audio portion of this project plays AIFF, AIFF-C,
+// and WAV files containing uncompressed PCM, see
+// audio_decode.go.  Files that are not 2 channel,
+// 44100 Hz are converted as they are loaded, using files
+// already in this format avoids the conversion.
 //
 // The conversion from ogg format files to this format
 // can be done using the libav-tools package installed
@@ -16,139 +18,201 @@ package mawt
 // Playback using the same tools for testing purposes
 // can be done using
 // "aplay -D plug:dmix -f S16_LE -c 2 -r 44100 assets/sounds/e-ambient.aiff"
+//
+// The ambient audio and sound effects are combined using the
+// software mixer found in mixer.go and sent to the sound card,
+// or another audio sink, as a single stream
 
 import (
-	"flag"
-	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/cvanderschuere/alsa-go"
-
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 )
 
-var (
-	audioDir = flag.String("audioDir", "assets/sounds", "The directory in which the audio aiff formatted event files can be found")
-)
+// AudioConfig contains the settings used for the audio output
+//
+type AudioConfig struct {
+	Dir  string // The directory in which the aiff or wav formatted sounds are found
+	Sink string // The audio output, see audio_sink.go
 
-func InitAudio(ambientC <-chan string, sfxC <-chan []string, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	AmbientGain float64 // The gain, 0.0 to 1.0, applied to the ambient audio
+	EffectGain  float64 // The gain, 0.0 to 1.0, applied to sound effects
+	Duck        float64 // The gain applied to the ambient audio while sound effects are playing
 
-	go runAudio(ambientC, sfxC, errorC, quitC)
+	RemoteCaptures bool // Play sounds for the capture of portals other than the home portal
+}
 
-	return nil
+// DefaultAudioConfig returns the audio settings used when none are supplied
+//
+func DefaultAudioConfig() (cfg AudioConfig) {
+	return AudioConfig{
+		Dir:         "assets/sounds",
+		Sink:        defaultAudioSink,
+		AmbientGain: 0.6,
+		EffectGain:  1.0,
+		Duck:        0.35,
+	}
 }
 
-type effects struct {
-	wakeup chan struct{}
-	sfxs   []string
-	stream alsa.AudioStream
+const (
+	// The number of bytes of mixed audio sent to the audio sink in each
+	// write, 1024 stereo frames or roughly 23ms
+	audioChunk = 4096
+)
+
+// AudioStatus describes the audio output
+//
+type AudioStatus struct {
+	Sink    string `json:"sink"`
+	Running bool   `json:"running"` // Set while audio is being sent to the sink
+	Muted   bool   `json:"muted"`
+	Ambient string `json:"ambient"`         // The ambient sound requested most recently
+	Effects int    `json:"effects"`         // The number of sound effects being mixed
+	Error   string `json:"error,omitempty"` // Why the audio stopped, or could not be started
+}
+
+// AudioPlayer is the audio output started by InitAudio
+//
+type AudioPlayer struct {
+	sink    string
+	mixer   *Mixer
+	running bool
+	ambient string
+	failure errors.Error
 	sync.Mutex
 }
 
-var (
-	sfxs = effects{
-		wakeup: make(chan struct{}, 1),
-		sfxs:   []string{},
-	}
-)
+// InitAudio starts playing the ambient sounds and effects requested using the channels,
+// a player is returned even when the audio could not be started so that the failure
+// can be reported by its Status
+//
+func InitAudio(cfg AudioConfig, ambientC <-chan string, sfxC <-chan []string, errorC chan<- errors.Error, quitC <-chan struct{}) (player *AudioPlayer, err errors.Error) {
 
-func reportError(err errors.Error, errorC chan<- errors.Error) {
-	select {
-	case errorC <- err:
-	case <-time.After(20 * time.Millisecond):
+	player = &AudioPlayer{
+		sink:  cfg.Sink,
+		mixer: NewMixer(float32(cfg.AmbientGain), float32(cfg.EffectGain), float32(cfg.Duck)),
 	}
-}
 
-func (sfxs *effects) playfile(fp string, quitC <-chan struct{}) (err errors.Error) {
-	file, errGo := os.Open(fp)
-	if errGo != nil {
-		return errors.Wrap(errGo).With("file", fp).With("stack", stack.Trace().TrimRuntime())
+	sink, err := newAudioSink(cfg.Sink, mixerChannels, mixerRate)
+	if err != nil {
+		player.failure = err
+		return player, err
 	}
-	defer file.Close()
+	player.running = true
 
-	data := make([]byte, 8192)
+	go runAudio(player, cfg.Dir, ambientC, sfxC, errorC, quitC)
 
-	for {
-		data = data[:cap(data)]
-		n, errGo := file.Read(data)
-		if errGo != nil {
-			if errGo == io.EOF {
-				return
-			}
-			return errors.Wrap(errGo).With("file", fp).With("stack", stack.Trace().TrimRuntime())
-		}
-		data = data[:n]
+	go func() {
+		err := playMixer(player.mixer, sink, errorC, quitC)
 
-		select {
-		case sfxs.stream.DataStream <- append([]byte(nil), data[:n]...):
-		case <-quitC:
-			return
+		player.Lock()
+		player.running = false
+		player.failure = err
+		player.Unlock()
+
+		if err != nil {
+			reportError(err, errorC)
 		}
-	}
+	}()
+
+	return player, nil
 }
 
-func (sfxs *effects) playback(quitC <-chan struct{}) (err errors.Error) {
-	for {
-		fp := ""
-		sfxs.Lock()
-		if len(sfxs.sfxs) != 0 {
-			fp = sfxs.sfxs[0]
-			sfxs.sfxs = sfxs.sfxs[1:]
-		}
-		sfxs.Unlock()
+// Mute silences, or restores, the audio
+//
+func (player *AudioPlayer) Mute(muted bool) {
+	player.mixer.SetMuted(muted)
+}
 
-		if len(fp) == 0 {
-			return nil
-		}
-		if err = sfxs.playfile(fp, quitC); err != nil {
-			return err
-		}
+// Status returns the state of the audio output
+//
+func (player *AudioPlayer) Status() (status AudioStatus) {
+	player.Lock()
+	defer player.Unlock()
+
+	status = AudioStatus{
+		Sink:    player.sink,
+		Running: player.running,
+		Muted:   player.mixer.Muted(),
+		Ambient: player.ambient,
+		Effects: player.mixer.Playing(),
+	}
+	if player.failure != nil {
+		status.Error = player.failure.Error()
 	}
+	return status
 }
 
-func playSFX(errorC chan<- errors.Error, quitC <-chan struct{}) {
-	//Open ALSA pipe
-	controlC := make(chan bool)
-	//Create stream
-	streamC := alsa.Init(controlC)
+func reportError(err errors.Error, errorC chan<- errors.Error) {
+	select {
+	case errorC <- err:
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// clipCache retains the samples for audio files that have been played so
+// that they do not need to be reloaded each time
+//
+type clipCache struct {
+	clips map[string][]int16
+	sync.Mutex
+}
 
-	sfxs.stream = alsa.AudioStream{Channels: 2,
-		Rate:         int(44100),
-		SampleFormat: alsa.INT16_TYPE,
-		DataStream:   make(chan alsa.AudioData, 100),
+var (
+	clips = clipCache{
+		clips: map[string][]int16{},
 	}
+)
 
-	streamC <- sfxs.stream
+// load returns the interleaved stereo samples for the audio file
+//
+func (cache *clipCache) load(fp string) (samples []int16, err errors.Error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if samples, isPresent := cache.clips[fp]; isPresent {
+		return samples, nil
+	}
+
+	samples, err = decodeAudioFile(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.clips[fp] = samples
+	return samples, nil
+}
+
+// playMixer sends the output of the mixer to the audio sink until the quitC is closed,
+// or the audio can no longer be played
+//
+func playMixer(mixer io.Reader, sink AudioSink, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
 
 	defer func() {
-		sfxs.Lock()
-		close(sfxs.wakeup)
-		sfxs.Unlock()
+		if errClose := sink.Close(); errClose != nil {
+			reportError(errClose, errorC)
+		}
 	}()
 
-	sfxs.Lock()
-	wakeup := sfxs.wakeup
-	sfxs.Unlock()
-
 	for {
-		if err := sfxs.playback(quitC); err != nil {
-			if errorC != nil {
-				reportError(err, errorC)
-			} else {
-				fmt.Fprintln(os.Stderr, err.Error())
-			}
+		data := make([]byte, audioChunk)
+		if _, errGo := io.ReadFull(mixer, data); errGo != nil {
+			return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		if err = sink.Write(data); err != nil {
+			return err
 		}
 
 		select {
-		case <-wakeup:
-		case <-time.After(time.Second):
 		case <-quitC:
-			return
+			return nil
+		default:
 		}
 	}
 }
@@ -161,123 +225,95 @@ func playSFX(errorC chan<- errors.Error, quitC <-chan struct{}) {
 // e-loss, r-loss, n-loss
 // e-resonator-deployed, r-resonator-deployed
 // e-resonator-destroyed, r-resonator-destroyed
+// e-resonator-upgraded, r-resonator-upgraded
+// e-remote-capture, r-remote-capture
+//
+// The deployed and upgraded sounds are not yet in assets/sounds,
+// until they are added the destroyed sound for the same faction
+// is played in their place, see audioFallbacks
+//
+// Effects for which no file is present in the audio directory,
+// or whose file cannot be decoded, are skipped with an error
+// being reported the first time the effect is requested
+//
+// The effects sent in a single request are played one after
+// the other, effects sent in separate requests will be mixed
+// together if they overlap
+
+// audioFiles are the file extensions that are searched for, in order, when
+// a sound is played
+var audioFiles = []string{".aiff", ".aif", ".aifc", ".wav"}
+
+// audioFallbacks are the sounds played for effects that have no file of their own
+var audioFallbacks = map[string]string{
+	"e-resonator-deployed": "e-resonator-destroyed",
+	"r-resonator-deployed": "r-resonator-destroyed",
+	"e-resonator-upgraded": "e-resonator-destroyed",
+	"r-resonator-upgraded": "r-resonator-destroyed",
+}
 
-func runAudio(ambientC <-chan string, sfxC <-chan []string, errorC chan<- errors.Error, quitC <-chan struct{}) {
-
-	go playAmbient(ambientC, errorC, quitC)
-
-	go playSFX(errorC, quitC)
-
-	for {
-		select {
-
-		case fns := <-sfxC:
-			if len(fns) != 0 {
-				sfxs.Lock()
-				for _, fn := range fns {
-					sfxs.sfxs = append(sfxs.sfxs, filepath.Join(*audioDir, fn+".aiff"))
-				}
-				// Wait a maximum of three seconds to wake up the audio
-				// player for sound effects
-				select {
-				case sfxs.wakeup <- struct{}{}:
-				case <-time.After(3 * time.Second):
-				}
-				sfxs.Unlock()
+// findAudio returns the file for a sound in the audio directory, or its fallback
+// when the sound has no file, an empty string is returned when neither is present
+//
+func findAudio(dir string, fn string) (fp string) {
+	for _, name := range []string{fn, audioFallbacks[fn]} {
+		if len(name) == 0 {
+			continue
+		}
+		for _, ext := range audioFiles {
+			fp = filepath.Join(dir, name+ext)
+			if _, errGo := os.Stat(fp); errGo == nil {
+				return fp
 			}
-		case <-quitC:
-			return
 		}
 	}
+	return ""
 }
 
-type ambientFP struct {
-	fp   string
-	file *os.File
-	sync.Mutex
-}
+func runAudio(player *AudioPlayer, dir string, ambientC <-chan string, sfxC <-chan []string, errorC chan<- errors.Error, quitC <-chan struct{}) {
 
-func playAmbient(ambientC <-chan string, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	reported := map[string]bool{}
 
-	ambient := ambientFP{}
+	load := func(fn string) (samples []int16) {
+		if reported[fn] {
+			return nil
+		}
 
-	go func() {
-		for {
-			select {
-			case fn := <-ambientC:
-				ambient.Lock()
-				ambient.fp = filepath.Join(*audioDir, fn)
-				ambient.fp += ".aiff"
-				ambient.Unlock()
-			case <-quitC:
-				return
+		if fp := findAudio(dir, fn); len(fp) != 0 {
+			samples, err := clips.load(fp)
+			if err != nil {
+				reported[fn] = true
+				reportError(err, errorC)
+				return nil
 			}
+			return samples
 		}
-	}()
 
-	//Open ALSA pipe
-	controlC := make(chan bool)
-	//Create stream
-	streamC := alsa.Init(controlC)
-
-	stream := alsa.AudioStream{Channels: 2,
-		Rate:         int(44100),
-		SampleFormat: alsa.INT16_TYPE,
-		DataStream:   make(chan alsa.AudioData, 100),
+		reported[fn] = true
+		reportError(errors.New("no audio file found for sound").With("sound", fn).With("dir", dir).With("stack", stack.Trace().TrimRuntime()), errorC)
+		return nil
 	}
 
-	streamC <- stream
-
-	errGo := fmt.Errorf("")
-	data := make([]byte, 8192)
-
-	func() {
-		fp := ""
-		for {
-			ambient.Lock()
-			if fp != ambient.fp {
-				if ambient.file != nil {
-					ambient.file.Close()
-					ambient.file = nil
-				}
-				if ambient.fp != "" {
-					if ambient.file, errGo = os.Open(ambient.fp); errGo != nil {
-
-						err := errors.Wrap(errGo).With("file", fp).With("stack", stack.Trace().TrimRuntime())
-						reportError(err, errorC)
-
-						ambient.fp = ""
-						continue
-					}
-					fp = ambient.fp
-				}
+	for {
+		select {
+		case fn := <-ambientC:
+			player.Lock()
+			player.ambient = fn
+			player.Unlock()
 
-			}
-			ambient.Unlock()
-			if ambient.file == nil {
-				select {
-				case <-time.After(250 * time.Millisecond):
-				}
-				continue
-			}
+			player.mixer.SetAmbient(load(fn))
 
-			data = data[:cap(data)]
-			n, errGo := ambient.file.Read(data)
-			if errGo != nil {
-				if errGo == io.EOF {
-					ambient.file.Seek(0, 0)
-					continue
+		case fns := <-sfxC:
+			effects := [][]int16{}
+			for _, fn := range fns {
+				if samples := load(fn); len(samples) != 0 {
+					effects = append(effects, samples)
 				}
-				err := errors.Wrap(errGo).With("file", fp).With("stack", stack.Trace().TrimRuntime())
-				reportError(err, errorC)
-				continue
 			}
+			player.mixer.AddEffect(1.0, effects...)
 
-			select {
-			case stream.DataStream <- append([]byte(nil), data[:n]...):
-			case <-quitC:
-				return
-			}
+		case <-quitC:
+			return
 		}
-	}()
+	}
 }
@@ -0,0 +1,107 @@
+// +build !noalsa
+
+package mawt
+
+// This file contains the audio sink for sound cards accessed using ALSA
+
+/*
+#cgo pkg-config: alsa
+#include <stdlib.h>
+#include <asoundlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/cvanderschuere/alsa-go"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultAudioSink = "alsa"
+
+	// The device alsa-go plays to, it cannot be configured
+	alsaDevice = "default"
+
+	// The number of writes that can be queued for the sound card, this
+	// determines the latency between an effect being requested and it
+	// being heard
+	alsaQueue = 4
+
+	// How long a write waits for the sound card to take audio before the
+	// sound card is considered to have stopped playing
+	alsaWriteTimeout = 2 * time.Second
+)
+
+func init() {
+	audioSinks["alsa"] = newAlsaSink
+}
+
+type alsaSink struct {
+	controlC chan bool
+	dataC    chan alsa.AudioData
+}
+
+// probeAlsa opens, and then closes, the device so that a missing or busy sound card
+// can be reported as alsa-go logs, rather than returns, a failure to open it
+//
+func probeAlsa(device string) (err errors.Error) {
+	name := C.CString(device)
+	defer C.free(unsafe.Pointer(name))
+
+	var pcm *C.snd_pcm_t
+	if result := C.snd_pcm_open(&pcm, name, C.SND_PCM_STREAM_PLAYBACK, C.SND_PCM_NONBLOCK); result < 0 {
+		errGo := fmt.Errorf("sound card could not be opened, %s", C.GoString(C.snd_strerror(result)))
+		return errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+	C.snd_pcm_close(pcm)
+	return nil
+}
+
+func newAlsaSink(target string, channels int, rate int) (sink AudioSink, err errors.Error) {
+	if err = probeAlsa(alsaDevice); err != nil {
+		return nil, err
+	}
+
+	alsaOut := &alsaSink{
+		controlC: make(chan bool),
+		dataC:    make(chan alsa.AudioData, alsaQueue),
+	}
+
+	//Create stream
+	streamC := alsa.Init(alsaOut.controlC)
+
+	streamC <- alsa.AudioStream{Channels: channels,
+		Rate:         rate,
+		SampleFormat: alsa.INT16_TYPE,
+		DataStream:   alsaOut.dataC,
+	}
+
+	return alsaOut, nil
+}
+
+// Write queues audio for the sound card, blocking while the queue is full.  A sound card
+// that stops taking audio causes an error rather than blocking the mixer indefinitely.
+//
+func (sink *alsaSink) Write(data []byte) (err errors.Error) {
+	timer := time.NewTimer(alsaWriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case sink.dataC <- data:
+		return nil
+	case <-timer.C:
+		errGo := fmt.Errorf("sound card stopped taking audio")
+		return errors.Wrap(errGo).With("device", alsaDevice).With("timeout", alsaWriteTimeout).With("stack", stack.Trace().TrimRuntime())
+	}
+}
+
+func (sink *alsaSink) Close() (err errors.Error) {
+	close(sink.controlC)
+	return nil
+}
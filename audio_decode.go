@@ -0,0 +1,323 @@
+package mawt
+
+// This module implements a decoder for the AIFF, AIFF-C, and WAV audio file
+// containers.  Files are validated and their samples converted to the 16 bit,
+// 2 channel, 44100 Hz format used by the mixer, resampling and changing the
+// number of channels when the file does not already match.
+//
+// Supported encodings are integer PCM of 8, 16, 24, or 32 bits, big endian
+// AIFF and AIFF-C NONE/twos, little endian AIFF-C sowt, and WAV integer or
+// 32 bit float PCM.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// audioFormat describes the layout of the samples within a file
+//
+type audioFormat struct {
+	channels  int
+	rate      float64
+	bits      int
+	bigEndian bool
+	float     bool
+	unsigned  bool // 8 bit WAV samples are unsigned
+}
+
+// decodeAudioFile loads an audio file and returns interleaved stereo samples at the mixer rate
+//
+func decodeAudioFile(fp string) (samples []int16, err errors.Error) {
+	data, errGo := ioutil.ReadFile(fp)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fp).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if samples, err = decodeAudio(data); err != nil {
+		return nil, err.With("file", fp)
+	}
+	return samples, nil
+}
+
+// decodeAudio examines the container of the audio data and decodes it accordingly
+//
+func decodeAudio(data []byte) (samples []int16, err errors.Error) {
+
+	if len(data) < 12 {
+		return nil, errors.New("audio file is too short to contain a header").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	format := audioFormat{}
+	pcm := []byte{}
+
+	switch string(data[0:4]) + string(data[8:12]) {
+	case "FORMAIFF", "FORMAIFC":
+		format, pcm, err = parseAIFF(data)
+	case "RIFFWAVE":
+		format, pcm, err = parseWAV(data)
+	default:
+		return nil, errors.New("audio file is not an AIFF, AIFF-C, or WAV file").With("stack", stack.Trace().TrimRuntime())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if format.channels < 1 {
+		return nil, errors.New("audio file has no channels").With("stack", stack.Trace().TrimRuntime())
+	}
+	if format.rate < 1 || format.rate > 384000 {
+		return nil, errors.New("audio file has an invalid sample rate").With("rate", format.rate).With("stack", stack.Trace().TrimRuntime())
+	}
+	switch {
+	case format.float && format.bits != 32:
+		return nil, errors.New("audio file floating point samples must be 32 bits").With("bits", format.bits).With("stack", stack.Trace().TrimRuntime())
+	case format.bits != 8 && format.bits != 16 && format.bits != 24 && format.bits != 32:
+		return nil, errors.New("audio file sample size is not supported").With("bits", format.bits).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	frameSize := format.channels * format.bits / 8
+	if len(pcm)%frameSize != 0 {
+		// Drop a trailing partial frame rather than rejecting the file
+		pcm = pcm[:len(pcm)-len(pcm)%frameSize]
+	}
+
+	return resample(toStereo(toInt16(pcm, format), format.channels), format.rate, mixerRate), nil
+}
+
+// chunks splits the body of an IFF or RIFF container into its chunks, which are
+// padded to an even length
+//
+func chunks(body []byte, order binary.ByteOrder) (found map[string][]byte, err errors.Error) {
+	found = map[string][]byte{}
+
+	for len(body) >= 8 {
+		id := string(body[0:4])
+		size := int64(order.Uint32(body[4:8]))
+		body = body[8:]
+
+		if size > int64(len(body)) {
+			// Some encoders leave the size of the final data chunk unset when
+			// streaming, use what is present
+			if id != "SSND" && id != "data" {
+				return nil, errors.New("audio file chunk is truncated").With("chunk", id).With("stack", stack.Trace().TrimRuntime())
+			}
+			size = int64(len(body))
+		}
+		if _, isPresent := found[id]; !isPresent {
+			found[id] = body[:size]
+		}
+
+		if size%2 != 0 && size < int64(len(body)) {
+			size++
+		}
+		body = body[size:]
+	}
+	return found, nil
+}
+
+// extendedToFloat converts the 80 bit IEEE 754 extended precision value used
+// by AIFF for the sample rate
+//
+func extendedToFloat(ext []byte) (value float64) {
+	exponent := int(binary.BigEndian.Uint16(ext[0:2]))
+	mantissa := binary.BigEndian.Uint64(ext[2:10])
+
+	sign := 1.0
+	if exponent&0x8000 != 0 {
+		sign = -1.0
+		exponent &= 0x7fff
+	}
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+	return sign * math.Ldexp(float64(mantissa), exponent-16383-63)
+}
+
+func parseAIFF(data []byte) (format audioFormat, pcm []byte, err errors.Error) {
+
+	isAIFC := string(data[8:12]) == "AIFC"
+
+	found, err := chunks(data[12:], binary.BigEndian)
+	if err != nil {
+		return format, nil, err
+	}
+
+	comm, isPresent := found["COMM"]
+	if !isPresent || len(comm) < 18 {
+		return format, nil, errors.New("AIFF file has a missing or short COMM chunk").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	format.channels = int(int16(binary.BigEndian.Uint16(comm[0:2])))
+	format.bits = int(int16(binary.BigEndian.Uint16(comm[6:8])))
+	format.rate = extendedToFloat(comm[8:18])
+	format.bigEndian = true
+
+	if isAIFC {
+		if len(comm) < 22 {
+			return format, nil, errors.New("AIFF-C file COMM chunk is missing the compression type").With("stack", stack.Trace().TrimRuntime())
+		}
+		switch compression := string(comm[18:22]); compression {
+		case "NONE", "twos":
+		case "sowt":
+			format.bigEndian = false
+		default:
+			return format, nil, errors.New("AIFF-C compression type is not supported, only uncompressed PCM can be played").
+				With("compression", compression).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	ssnd, isPresent := found["SSND"]
+	if !isPresent || len(ssnd) < 8 {
+		return format, nil, errors.New("AIFF file has a missing or short SSND chunk").With("stack", stack.Trace().TrimRuntime())
+	}
+	offset := int64(binary.BigEndian.Uint32(ssnd[0:4]))
+	if 8+offset > int64(len(ssnd)) {
+		return format, nil, errors.New("AIFF file SSND offset is beyond the end of the chunk").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// AIFF stores sample sizes that are not a whole number of bytes in the most
+	// significant bits of the next largest size
+	format.bits = (format.bits + 7) / 8 * 8
+
+	return format, ssnd[8+offset:], nil
+}
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatExtensible = 0xfffe
+)
+
+func parseWAV(data []byte) (format audioFormat, pcm []byte, err errors.Error) {
+
+	found, err := chunks(data[12:], binary.LittleEndian)
+	if err != nil {
+		return format, nil, err
+	}
+
+	fmtChunk, isPresent := found["fmt "]
+	if !isPresent || len(fmtChunk) < 16 {
+		return format, nil, errors.New("WAV file has a missing or short fmt chunk").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	tag := binary.LittleEndian.Uint16(fmtChunk[0:2])
+	format.channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+	format.rate = float64(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+	format.bits = int(binary.LittleEndian.Uint16(fmtChunk[14:16]))
+
+	if tag == wavFormatExtensible {
+		if len(fmtChunk) < 26 {
+			return format, nil, errors.New("WAV file extensible fmt chunk is too short").With("stack", stack.Trace().TrimRuntime())
+		}
+		// The first two bytes of the sub format GUID carry the format tag
+		tag = binary.LittleEndian.Uint16(fmtChunk[24:26])
+	}
+
+	switch tag {
+	case wavFormatPCM:
+		format.unsigned = format.bits == 8
+	case wavFormatFloat:
+		format.float = true
+	default:
+		errGo := fmt.Errorf("WAV format 0x%04x is not supported, only PCM and 32 bit float can be played", tag)
+		return format, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	pcm, isPresent = found["data"]
+	if !isPresent {
+		return format, nil, errors.New("WAV file has no data chunk").With("stack", stack.Trace().TrimRuntime())
+	}
+	return format, pcm, nil
+}
+
+// toInt16 converts the raw samples to 16 bit values, keeping the most significant bits
+//
+func toInt16(pcm []byte, format audioFormat) (samples []int16) {
+	width := format.bits / 8
+	samples = make([]int16, len(pcm)/width)
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if format.bigEndian {
+		order = binary.BigEndian
+	}
+
+	for i := range samples {
+		sample := pcm[i*width : (i+1)*width]
+		switch {
+		case format.float:
+			value := float64(math.Float32frombits(order.Uint32(sample)))
+			samples[i] = int16(math.Max(-1.0, math.Min(1.0, value)) * math.MaxInt16)
+		case width == 1 && format.unsigned:
+			samples[i] = int16(int(sample[0])-128) << 8
+		case width == 1:
+			samples[i] = int16(int8(sample[0])) << 8
+		case width == 2:
+			samples[i] = int16(order.Uint16(sample))
+		case width == 3 && format.bigEndian:
+			samples[i] = int16(uint16(sample[0])<<8 | uint16(sample[1]))
+		case width == 3:
+			samples[i] = int16(uint16(sample[2])<<8 | uint16(sample[1]))
+		case width == 4:
+			samples[i] = int16(order.Uint32(sample) >> 16)
+		}
+	}
+	return samples
+}
+
+// toStereo converts interleaved samples with the supplied number of channels to
+// stereo, mono is copied to both sides and only the front left and right are
+// kept from surround sound
+//
+func toStereo(samples []int16, channels int) (stereo []int16) {
+	if channels == 2 {
+		return samples
+	}
+
+	frames := len(samples) / channels
+	stereo = make([]int16, frames*2)
+	for frame := 0; frame < frames; frame++ {
+		left := samples[frame*channels]
+		right := left
+		if channels > 1 {
+			right = samples[frame*channels+1]
+		}
+		stereo[frame*2] = left
+		stereo[frame*2+1] = right
+	}
+	return stereo
+}
+
+// resample converts interleaved stereo samples from one rate to another using
+// linear interpolation, which is adequate for the short effects being played
+//
+func resample(stereo []int16, from float64, to float64) (samples []int16) {
+	if from == to || len(stereo) < 2 {
+		return stereo
+	}
+
+	inFrames := len(stereo) / 2
+	outFrames := int(float64(inFrames) * to / from)
+	samples = make([]int16, outFrames*2)
+
+	step := from / to
+	for frame := 0; frame < outFrames; frame++ {
+		pos := float64(frame) * step
+		index := int(pos)
+		frac := pos - float64(index)
+		next := index + 1
+		if next >= inFrames {
+			next = inFrames - 1
+		}
+		for channel := 0; channel < 2; channel++ {
+			a := float64(stereo[index*2+channel])
+			b := float64(stereo[next*2+channel])
+			samples[frame*2+channel] = int16(a + (b-a)*frac)
+		}
+	}
+	return samples
+}
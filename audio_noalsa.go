@@ -0,0 +1,10 @@
+// +build noalsa
+
+package mawt
+
+// This file is used for builds without ALSA, in which case the audio is
+// discarded unless another sink is selected
+
+const (
+	defaultAudioSink = "null"
+)
@@ -0,0 +1,256 @@
+package mawt
+
+// This module defines the interface through which mixed audio is delivered
+// to an output along with the outputs that do not depend upon sound hardware,
+// a null sink that discards audio, a recorder that writes a WAV file, and a
+// sink that writes the raw samples to stdout so that they can be piped into
+// another program such as aplay.
+//
+// The ALSA sink is found in audio_alsa.go, and can be left out of builds for
+// machines without ALSA using the noalsa build tag.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// AudioSink is an output for interleaved 16 bit signed little endian samples
+//
+type AudioSink interface {
+	// Write blocks until the output is ready for more audio, the sink may
+	// retain the data so the caller must not modify it afterwards
+	Write(data []byte) (err errors.Error)
+	Close() (err errors.Error)
+}
+
+type audioSinkFactory func(target string, channels int, rate int) (sink AudioSink, err errors.Error)
+
+var (
+	audioSinks = map[string]audioSinkFactory{
+		"null":   newNullSink,
+		"wav":    newWavSink,
+		"stdout": newStdoutSink,
+	}
+)
+
+// newAudioSink creates a sink using a specification of the form name[:target],
+// for example "alsa", "null", "stdout", or "wav:/tmp/scenario.wav"
+//
+func newAudioSink(spec string, channels int, rate int) (sink AudioSink, err errors.Error) {
+	name, target := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, target = spec[:i], spec[i+1:]
+	}
+
+	factory, isPresent := audioSinks[name]
+	if !isPresent {
+		return nil, errors.New("unknown audio sink").With("sink", spec).With("stack", stack.Trace().TrimRuntime())
+	}
+	return factory(target, channels, rate)
+}
+
+// audioPacer is used by sinks that are not driven by a sound card clock to
+// consume audio at the rate it would be played
+//
+type audioPacer struct {
+	bytesPerSecond int64
+	start          time.Time
+	written        int64
+}
+
+func newAudioPacer(channels int, rate int) (pacer *audioPacer) {
+	return &audioPacer{
+		bytesPerSecond: int64(2 * channels * rate),
+	}
+}
+
+// wait blocks until the audio that has been written, including the additional
+// data, would have finished playing
+//
+func (pacer *audioPacer) wait(size int) {
+	now := time.Now()
+	if pacer.start.IsZero() {
+		pacer.start = now
+	}
+
+	pacer.written += int64(size)
+	due := pacer.start.Add(time.Duration(pacer.written * int64(time.Second) / pacer.bytesPerSecond))
+
+	delay := due.Sub(now)
+	if delay < -time.Second {
+		// The process was stalled, start again rather than rushing to catch up
+		pacer.start = now
+		pacer.written = 0
+		return
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// nullSink discards audio, for use when no sound output is needed
+//
+type nullSink struct {
+	pacer *audioPacer
+}
+
+func newNullSink(target string, channels int, rate int) (sink AudioSink, err errors.Error) {
+	return &nullSink{pacer: newAudioPacer(channels, rate)}, nil
+}
+
+func (sink *nullSink) Write(data []byte) (err errors.Error) {
+	sink.pacer.wait(len(data))
+	return nil
+}
+
+func (sink *nullSink) Close() (err errors.Error) {
+	return nil
+}
+
+// stdoutSink writes the raw samples to stdout, for example
+// "mawt -audioSink stdout | aplay -f S16_LE -c 2 -r 44100"
+//
+type stdoutSink struct {
+	output *os.File
+	pacer  *audioPacer
+}
+
+func newStdoutSink(target string, channels int, rate int) (sink AudioSink, err errors.Error) {
+	output, err := claimStdout()
+	if err != nil {
+		return nil, err
+	}
+	return &stdoutSink{
+		output: output,
+		pacer:  newAudioPacer(channels, rate),
+	}, nil
+}
+
+func (sink *stdoutSink) Write(data []byte) (err errors.Error) {
+	if _, errGo := sink.output.Write(data); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	sink.pacer.wait(len(data))
+	return nil
+}
+
+func (sink *stdoutSink) Close() (err errors.Error) {
+	if errGo := sink.output.Close(); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// wavHeader is the RIFF header for a canonical PCM WAV file
+//
+type wavHeader struct {
+	Riff          [4]byte
+	RiffSize      uint32
+	Wave          [4]byte
+	Fmt           [4]byte
+	FmtSize       uint32
+	Format        uint16
+	Channels      uint16
+	Rate          uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+	Data          [4]byte
+	DataSize      uint32
+}
+
+// wavSink records audio into a WAV file so that, for example, a simulator scenario
+// can be reviewed without sound hardware.  The header is kept up to date as audio is
+// written so the file remains playable should the gateway be stopped abruptly.
+//
+type wavSink struct {
+	fn     string
+	file   *os.File
+	header wavHeader
+	pacer  *audioPacer
+}
+
+func newWavSink(target string, channels int, rate int) (sink AudioSink, err errors.Error) {
+	if len(target) == 0 {
+		return nil, errors.New("the wav audio sink needs a file name, for example wav:/tmp/audio.wav").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	file, errGo := os.Create(target)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", target).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	wav := &wavSink{
+		fn:   target,
+		file: file,
+		header: wavHeader{
+			Riff:          [4]byte{'R', 'I', 'F', 'F'},
+			Wave:          [4]byte{'W', 'A', 'V', 'E'},
+			Fmt:           [4]byte{'f', 'm', 't', ' '},
+			FmtSize:       16,
+			Format:        1, // PCM
+			Channels:      uint16(channels),
+			Rate:          uint32(rate),
+			ByteRate:      uint32(2 * channels * rate),
+			BlockAlign:    uint16(2 * channels),
+			BitsPerSample: 16,
+			Data:          [4]byte{'d', 'a', 't', 'a'},
+		},
+		pacer: newAudioPacer(channels, rate),
+	}
+
+	if err = wav.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return wav, nil
+}
+
+func (sink *wavSink) writeHeader() (err errors.Error) {
+	sink.header.RiffSize = 36 + sink.header.DataSize
+
+	buf := &bytes.Buffer{}
+	if errGo := binary.Write(buf, binary.LittleEndian, &sink.header); errGo != nil {
+		return errors.Wrap(errGo).With("file", sink.fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo := sink.file.WriteAt(buf.Bytes(), 0); errGo != nil {
+		return errors.Wrap(errGo).With("file", sink.fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func (sink *wavSink) Write(data []byte) (err errors.Error) {
+	// The RIFF sizes are 32 bits, roughly 6 hours of CD quality audio
+	if uint64(sink.header.DataSize)+uint64(len(data)) > math.MaxUint32-36 {
+		errGo := fmt.Errorf("recording exceeds the maximum WAV file size")
+		return errors.Wrap(errGo).With("file", sink.fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	offset := int64(binary.Size(sink.header)) + int64(sink.header.DataSize)
+	if _, errGo := sink.file.WriteAt(data, offset); errGo != nil {
+		return errors.Wrap(errGo).With("file", sink.fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	sink.header.DataSize += uint32(len(data))
+
+	if err = sink.writeHeader(); err != nil {
+		return err
+	}
+
+	sink.pacer.wait(len(data))
+	return nil
+}
+
+func (sink *wavSink) Close() (err errors.Error) {
+	if errGo := sink.file.Close(); errGo != nil {
+		return errors.Wrap(errGo).With("file", sink.fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
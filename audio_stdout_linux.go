@@ -0,0 +1,29 @@
+package mawt
+
+// This file contains the linux implementation for handing stdout over to
+// the audio stream
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// claimStdout returns a file for the original stdout and then points stdout at stderr,
+// so that logging and terminal output from the rest of the gateway does not end up
+// mixed into the audio stream
+//
+func claimStdout() (output *os.File, err errors.Error) {
+	fd, errGo := unix.Dup(int(os.Stdout.Fd()))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = unix.Dup3(int(os.Stderr.Fd()), int(os.Stdout.Fd()), 0); errGo != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return os.NewFile(uintptr(fd), "audio"), nil
+}
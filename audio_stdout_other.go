@@ -0,0 +1,17 @@
+// +build !linux
+
+package mawt
+
+// This file contains a placeholder for platforms on which stdout cannot be
+// handed over to the audio stream, logging should be directed elsewhere when
+// the stdout audio sink is used on them
+
+import (
+	"os"
+
+	"github.com/karlmutch/errors"
+)
+
+func claimStdout() (output *os.File, err errors.Error) {
+	return os.Stdout, nil
+}
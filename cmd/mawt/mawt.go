@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"net"
@@ -30,15 +31,56 @@ import (
 var (
 	logger = logxi.New("mawt")
 
-	fcserver   = flag.String("server", "127.0.0.1:7890", "the ip and port for the fadecandy server (use /dev/null if none present)")
+	fcserver   = flag.String("server", mawt.DefaultLEDConfig().Server, "the ip and port for the fadecandy server, or channel ranges and servers such as 1-8=base:7890,9-24=tower:7890 (use /dev/null if none present)")
+	layoutFile = flag.String("layout", "", "an optional LED layout file, in either fcserver or mawt format, that is checked against the animation")
+	fps        = flag.Float64("fps", mawt.DefaultLEDConfig().FPS, "the target number of LED frames rendered each second")
 	terminal   = flag.Bool("term", false, "Used to define if a text user interface is being used")
+	record     = flag.String("record", "", "an optional file into which the LED frames are recorded, for playing back using the replay mode")
+
+	replaySpeed = flag.Float64("replay-speed", 1.0, "the speed at which a recording is played in replay mode, 1.0 being the original speed")
+	replayLoop  = flag.Bool("replay-loop", false, "when enabled replay mode will play the recording repeatedly until stopped")
+
+	// Set when mawt is started using "mawt replay [options] recording"
+	replayMode = false
 	verbose    = flag.Bool("v", false, "When enabled will print internal logging for this tool")
-	tecthulhus = flag.String("tecthulhus", "http://operation-wigwam.ingress.com:8080/v1/test-info", "A comma seperated list of IP based tecthulhus, the first being the 'home' portal")
+	tecthulhus = flag.String("tecthulhus", "http://operation-wigwam.ingress.com:8080/v1/test-info", "A comma seperated list of tecthulhu URLs, http:// or serial:///dev/ttyUSB0?baud=115200, in order of preference for the 'home' portal")
+	homePolicy = flag.String("home-policy", string(mawt.HomeFixed), "how the home portal driving the LEDs and audio is chosen, fixed, first-healthy, or most-recently-changed")
+	homePortal = flag.String("home-portal", "", "the tecthulhu URL used as the home portal by the fixed policy, the first of the tecthulhus by default")
+
+	pollInterval   = flag.Duration("poll-interval", mawt.DefaultPollConfig().Interval, "the regular interval between tecthulhu status checks")
+	pollFast       = flag.Duration("poll-fast", mawt.DefaultPollConfig().Fast, "the interval between tecthulhu status checks used after a portal change is seen")
+	pollFastWindow = flag.Duration("poll-fast-window", mawt.DefaultPollConfig().FastWindow, "how long after the last portal change the fast interval continues to be used")
+	pollTimeout    = flag.Duration("poll-timeout", mawt.DefaultPollConfig().Timeout, "the maximum time a single tecthulhu status check can take")
+	pollMaxBackoff = flag.Duration("poll-max-backoff", mawt.DefaultPollConfig().MaxBackoff, "the longest delay between status checks for a tecthulhu that is not responding")
+	pollJitter     = flag.Float64("poll-jitter", mawt.DefaultPollConfig().Jitter, "the fraction, 0.0 to 1.0, of each status check interval that is randomized")
+	offlineAfter   = flag.Duration("offline-after", mawt.DefaultPollConfig().OfflineAfter, "how long a tecthulhu can go without answering before it is reported as offline")
+
+	ledGamma          = flag.String("led-gamma", "1.0", "the gamma applied to the LEDs, either one value or red,green,blue values (set the fcserver gamma to 1.0 when used)")
+	ledWhitePoint     = flag.String("led-whitepoint", "1.0", "the full scale level, 0.0 to 1.0, of the LEDs, either one value or red,green,blue values")
+	ledBrightness     = flag.Float64("led-brightness", mawt.DefaultColorConfig().Brightness, "the maximum brightness, 0.0 to 1.0, of the LEDs")
+	ledMaxCurrent     = flag.Float64("led-max-current", mawt.DefaultColorConfig().MaxCurrent, "the current, in Amps, that the LED power supply can deliver, frames needing more are dimmed to fit (0 for no limit)")
+	ledChannelCurrent = flag.Float64("led-channel-current", mawt.DefaultColorConfig().ChannelCurrent, "the current, in milli Amps, drawn by one color of a single LED at full brightness")
+
+	neighborPixels    = flag.String("neighbor-pixels", "", "a comma separated list of universe:pixel values, such as base1:29,base2:29, showing the faction of each of the tecthulhus in order")
+	remoteAccent      = flag.Duration("remote-accent", 0, "how long the tower is tinted with the new faction when a portal other than the home portal is captured (0 to disable)")
+	remoteAccentLevel = flag.Float64("remote-accent-level", mawt.DefaultRegionalConfig().AccentLevel, "the strength, 0.0 to 1.0, of the tower tint used for captures of other portals")
+
+	audioDir            = flag.String("audioDir", mawt.DefaultAudioConfig().Dir, "The directory in which the audio aiff or wav formatted event files can be found")
+	audioSink           = flag.String("audioSink", mawt.DefaultAudioConfig().Sink, "The audio output, alsa, null, stdout, or wav:<file> to record into a file")
+	audioAmbientGain    = flag.Float64("audioAmbientGain", mawt.DefaultAudioConfig().AmbientGain, "The gain, 0.0 to 1.0, applied to the ambient audio")
+	audioEffectGain     = flag.Float64("audioEffectGain", mawt.DefaultAudioConfig().EffectGain, "The gain, 0.0 to 1.0, applied to sound effects")
+	audioDuck           = flag.Float64("audioDuck", mawt.DefaultAudioConfig().Duck, "The gain, 0.0 to 1.0, applied to the ambient audio while sound effects are playing")
+	audioRemoteCaptures = flag.Bool("audioRemoteCaptures", false, "Play the e-remote-capture and r-remote-capture sounds when portals other than the home portal are captured")
+
+	debugListen = flag.String("debug-listen", "0.0.0.0:6060", "the address on which the pprof, expvar, and LED viewer pages are served")
+	apiListen   = flag.String("api-listen", "127.0.0.1:6061", "the address on which the control and status API is served (empty to disable)")
+	apiToken    = flag.String("api-token", "", "a token that requests to the control and status API must supply as a bearer token (empty for none)")
 )
 
 func usage() {
 	fmt.Fprintln(os.Stderr, path.Base(os.Args[0]))
 	fmt.Fprintln(os.Stderr, "usage: ", os.Args[0], "[options]       techthulu ← TCP → OPC (mawt)      ", version.GitHash, "    ", version.BuildTime)
+	fmt.Fprintln(os.Stderr, "        ", os.Args[0], "replay [options] recording")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "mawt is a gateway between Niantic Ingress Techthulu and OPC based USB fadecandy boards")
 	fmt.Fprintln(os.Stderr, "")
@@ -78,6 +120,11 @@ func main() {
 func Main() {
 
 	if !flag.Parsed() {
+		// The replay mode is selected using a command ahead of the options
+		if len(os.Args) > 1 && os.Args[1] == "replay" {
+			replayMode = true
+			flag.CommandLine.Parse(os.Args[2:])
+		}
 		envflag.Parse()
 	}
 
@@ -124,7 +171,7 @@ func EntryPoint(quitC chan struct{}, doneC chan struct{}) (errs []errors.Error)
 	defer close(doneC)
 
 	go func() {
-		http.ListenAndServe("0.0.0.0:6060", nil)
+		http.ListenAndServe(*debugListen, nil)
 	}()
 
 	// Supplying the context allows the client to pubsub to cancel the
@@ -135,11 +182,14 @@ func EntryPoint(quitC chan struct{}, doneC chan struct{}) (errs []errors.Error)
 	errorC := make(chan errors.Error, 1)
 	msgC := make(chan string, 1)
 
+	// Closed when there is nothing more to be done, for example when a replay has ended
+	finishedC := make(chan struct{})
+
 	// Setup a channel to allow a CTRL-C to terminate all processing.  When the CTRL-C
 	// occurs we cancel the background msg pump processing pubsub mesages from
 	// google, and this will also cause the main thread to unblock and return
 	//
-	stopC := make(chan os.Signal)
+	stopC := make(chan os.Signal, 1)
 	go func() {
 		defer cancel()
 
@@ -158,6 +208,9 @@ func EntryPoint(quitC chan struct{}, doneC chan struct{}) (errs []errors.Error)
 				}
 			case <-quitC:
 				return
+			case <-finishedC:
+				close(quitC)
+				return
 			case <-stopC:
 				logger.Warn("CTRL-C Seen")
 				close(quitC)
@@ -168,9 +221,83 @@ func EntryPoint(quitC chan struct{}, doneC chan struct{}) (errs []errors.Error)
 
 	signal.Notify(stopC, os.Interrupt, syscall.SIGTERM)
 
+	if replayMode {
+		return startReplay(ctx, errorC, finishedC)
+	}
 	return startServer(ctx, msgC, errorC)
 }
 
+// ledConfig gathers the options used to drive the LEDs
+func ledConfig() (leds mawt.LEDConfig, err errors.Error) {
+
+	leds = mawt.DefaultLEDConfig()
+	leds.Server = *fcserver
+	leds.FPS = *fps
+	leds.Debug = *terminal
+
+	leds.Colors.Brightness = *ledBrightness
+	leds.Colors.MaxCurrent = *ledMaxCurrent
+	leds.Colors.ChannelCurrent = *ledChannelCurrent
+
+	gamma, err := mawt.ParseColorTriple(*ledGamma)
+	if err != nil {
+		return leds, err.With("flag", "led-gamma")
+	}
+	leds.Colors.Gamma = gamma
+
+	whitePoint, err := mawt.ParseColorTriple(*ledWhitePoint)
+	if err != nil {
+		return leds, err.With("flag", "led-whitepoint")
+	}
+	leds.Colors.WhitePoint = whitePoint
+
+	if len(*layoutFile) != 0 {
+		if leds.Layout, err = mawt.LoadLayout(*layoutFile); err != nil {
+			return leds, err
+		}
+	}
+
+	if leds.Regional.Pixels, err = mawt.ParseRegionalPixels(*neighborPixels); err != nil {
+		return leds, err.With("flag", "neighbor-pixels")
+	}
+	leds.Regional.Accent = *remoteAccent
+	leds.Regional.AccentLevel = *remoteAccentLevel
+
+	return leds, nil
+}
+
+// startReplay plays a recording of the LED frames, closing the finishedC once it has ended
+func startReplay(ctx context.Context, errorC chan errors.Error, finishedC chan struct{}) (errs []errors.Error) {
+
+	if flag.NArg() != 1 {
+		return append(errs, errors.New("replay mode needs the name of a single recording file").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	leds, err := ledConfig()
+	if err != nil {
+		return append(errs, err)
+	}
+
+	replay := mawt.ReplayConfig{
+		File:  flag.Arg(0),
+		Speed: *replaySpeed,
+		Loop:  *replayLoop,
+	}
+
+	fc, err := mawt.StartReplay(leds, replay, errorC, ctx.Done())
+	if err != nil {
+		return append(errs, err)
+	}
+	publishLEDs(fc)
+
+	go func() {
+		<-fc.Done()
+		close(finishedC)
+	}()
+
+	return errs
+}
+
 // Now start initializing the servers processing components
 func startServer(ctx context.Context, msgC chan string, errorC chan errors.Error) (errs []errors.Error) {
 
@@ -181,30 +308,120 @@ func startServer(ctx context.Context, msgC chan string, errorC chan errors.Error
 	// Eventually hook up error and message streams
 	go runTUI(msgC, errorC, ctx.Done())
 
-	gw := &mawt.Gateway{}
+	leds, err := ledConfig()
+	if err != nil {
+		return append(errs, err)
+	}
+	leds.Record = *record
+
+	poll := mawt.PollConfig{
+		Interval:   *pollInterval,
+		Fast:       *pollFast,
+		FastWindow: *pollFastWindow,
+		Timeout:    *pollTimeout,
+		MaxBackoff: *pollMaxBackoff,
+		Jitter:     *pollJitter,
 
-	statusC, subscribeC := gw.Start(*fcserver, *terminal, errorC, ctx.Done())
+		OfflineAfter: *offlineAfter,
+	}
+
+	home := mawt.HomeConfig{
+		Policy: mawt.HomePolicy(*homePolicy),
+		URLs:   []string{},
+	}
 
-	portals := strings.Split(*tecthulhus, ",")
-	for i, portal := range portals {
+	urls := []url.URL{}
+	for _, portal := range strings.Split(*tecthulhus, ",") {
 		url, errGo := url.Parse(portal)
 		if errGo != nil {
 			errs = append(errs, errors.Wrap(errGo).With("url", portal).With("stack", stack.Trace().TrimRuntime()))
 			continue
 		}
-		if len(url.Path) <= 1 {
+		if url.Scheme == "http" && len(url.Path) <= 1 {
 			logger.Warn("URL supplied without a path component, default one supplied")
 			url.Path = "/module/status/json"
 		}
-		tec := mawt.NewTecthulu(*url, i == 0, statusC, errorC)
+		urls = append(urls, *url)
+		home.URLs = append(home.URLs, url.String())
+
+		// The home portal can be given as it appears in the tecthulhus option
+		if len(*homePortal) != 0 && (*homePortal == portal || *homePortal == url.String()) {
+			home.Fixed = url.String()
+		}
+	}
+	if len(*homePortal) != 0 && len(home.Fixed) == 0 {
+		return append(errs, errors.New("the home portal is not one of the tecthulhus").With("flag", "home-portal").With("home", *homePortal).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// The neighbor pixels are assigned to the tecthulhus in the order they were given
+	leds.Regional.Portals = home.URLs
+
+	audio := mawt.AudioConfig{
+		Dir:            *audioDir,
+		Sink:           *audioSink,
+		AmbientGain:    *audioAmbientGain,
+		EffectGain:     *audioEffectGain,
+		Duck:           *audioDuck,
+		RemoteCaptures: *audioRemoteCaptures,
+	}
+
+	gw := &mawt.Gateway{}
+
+	fanout, err := gw.Start(leds, home, audio, errorC, ctx.Done())
+	if err != nil {
+		return append(errs, err)
+	}
+
+	publishLEDs(gw.LEDs())
+	expvar.Publish("fanout", fanout.Vars())
+
+	for _, url := range urls {
+		tec := mawt.NewTecthulu(url, poll, fanout, errorC)
 		go tec.Run(ctx.Done())
 	}
 
-	go runMonitoring(subscribeC, ctx.Done())
+	go runMonitoring(ctx, fanout)
+
+	if err = startAPI(gw); err != nil {
+		return append(errs, err)
+	}
 
 	return errs
 }
 
+// publishLEDs adds the LED viewer, and the statistics for the LEDs, to the debugging listener
+func publishLEDs(fc *mawt.FadeCandy) {
+	http.Handle("/leds/", fc.Viewer())
+	expvar.Publish("render", fc.RenderVars())
+	expvar.Publish("opc", fc.OPCVars())
+}
+
+// startAPI serves the control and status API, the listener is opened before returning
+// so that an address that cannot be used is reported as a startup failure
+func startAPI(gw *mawt.Gateway) (err errors.Error) {
+	if len(*apiListen) == 0 {
+		return nil
+	}
+
+	listener, errGo := net.Listen("tcp", *apiListen)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("flag", "api-listen").With("address", *apiListen).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if len(*apiToken) == 0 {
+		if tcp, isTCP := listener.Addr().(*net.TCPAddr); !isTCP || !tcp.IP.IsLoopback() {
+			logger.Warn(fmt.Sprintf("the control API on %s can be used without a token, consider setting -api-token", listener.Addr()))
+		}
+	}
+
+	go func() {
+		if errGo := http.Serve(listener, mawt.NewAPI(gw, *apiToken)); errGo != nil {
+			logger.Warn(errors.Wrap(errGo).With("address", *apiListen).With("stack", stack.Trace().TrimRuntime()).Error())
+		}
+	}()
+	return nil
+}
+
 func exclusive(name string, quitC chan struct{}) (err errors.Error) {
 
 	excl := struct {
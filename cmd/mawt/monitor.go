@@ -1,25 +1,52 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"time"
 
+	"github.com/TeamNorCal/mawt"
 	"github.com/TeamNorCal/mawt/model"
 )
 
 // This file implements a monitor that subscribe to and displays
 // the tecthulhu events using event subscription
 
-func runMonitoring(subscribeC chan chan *model.PortalMsg, quitC <-chan struct{}) {
+func runMonitoring(ctx context.Context, fanout *mawt.FanOut) {
 
-	statusC := make(chan *model.PortalMsg, 1)
-	defer close(statusC)
-	subscribeC <- statusC
+	// Errors are not monitored as they are already logged by the application
+	filter := mawt.Filter{
+		Topics: []mawt.Topic{mawt.TopicStatus, mawt.TopicEvents, mawt.TopicHealth, mawt.TopicHome},
+	}
+	sub := fanout.Subscribe(ctx, "monitor", filter, mawt.Queue{Size: 16, Policy: mawt.DropOldest})
 
 	for {
 		select {
-		case msg := <-statusC:
-			logger.Debug(fmt.Sprintf("%+v", msg))
-		case <-quitC:
+		case msg, isOpen := <-sub.C:
+			if !isOpen {
+				return
+			}
+			switch msg.Topic {
+			case mawt.TopicHealth:
+				health := msg.Health
+				// Connectivity changes are of interest to operators even when debugging is off
+				if health.State == model.HealthOnline || health.State == model.HealthConnecting {
+					logger.Info(fmt.Sprintf("tecthulhu %s is %s (was %s)", health.URL, health.State, health.Previous))
+				} else {
+					lastSeen := "never"
+					if !health.LastSeen.IsZero() {
+						lastSeen = health.LastSeen.Format(time.RFC3339)
+					}
+					logger.Warn(fmt.Sprintf("tecthulhu %s is %s (was %s) after %d failures, last seen %s", health.URL, health.State, health.Previous, health.Failures, lastSeen))
+				}
+			case mawt.TopicHome:
+				logger.Info(fmt.Sprintf("home portal is now %s (was %s) using the %s policy", msg.HomeChange.URL, msg.HomeChange.Previous, msg.HomeChange.Policy))
+			case mawt.TopicStatus:
+				logger.Debug(fmt.Sprintf("%+v", msg.Status))
+			case mawt.TopicEvents:
+				logger.Debug(fmt.Sprintf("%+v", msg.Event))
+			}
+		case <-ctx.Done():
 			return
 		}
 	}
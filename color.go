@@ -0,0 +1,169 @@
+package mawt
+
+// This module implements the color correction applied to frames before they
+// are sent to the fadecandy servers.  Each channel has a gamma curve and a
+// white point scale that are combined into a lookup table, a global brightness
+// limit is applied, and lastly frames that would draw more current than the
+// power supply can deliver are scaled down to fit within its budget.
+//
+// When the correction is done by mawt the color section of the fcserver
+// configuration should be left at a gamma of 1.0 and a white point of
+// [1.0, 1.0, 1.0] to avoid the correction being applied twice.
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// ColorConfig contains the color correction settings, the default leaves
+// colors unchanged
+//
+type ColorConfig struct {
+	Gamma      [3]float64 // The red, green, and blue gamma exponents
+	WhitePoint [3]float64 // The red, green, and blue full scale levels, 0.0 to 1.0
+	Brightness float64    // The maximum brightness of any LED, 0.0 to 1.0
+
+	MaxCurrent     float64 // The power supply budget in Amps, 0 for no limit
+	ChannelCurrent float64 // The current in milli Amps drawn by a single color of one LED at full brightness
+}
+
+// DefaultColorConfig returns the color settings used when none are supplied
+//
+func DefaultColorConfig() (cfg ColorConfig) {
+	return ColorConfig{
+		Gamma:      [3]float64{1.0, 1.0, 1.0},
+		WhitePoint: [3]float64{1.0, 1.0, 1.0},
+		Brightness: 1.0,
+
+		MaxCurrent:     0,
+		ChannelCurrent: 20, // WS2811 and WS2812 LEDs
+	}
+}
+
+// ParseColorTriple parses a single value applied to all three color channels, or three
+// comma separated values for red, green, and blue
+//
+func ParseColorTriple(spec string) (values [3]float64, err errors.Error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 1 && len(parts) != 3 {
+		errGo := fmt.Errorf("expected either one value, or three comma separated values")
+		return values, errors.Wrap(errGo).With("value", spec).With("stack", stack.Trace().TrimRuntime())
+	}
+	for i := range values {
+		part := parts[0]
+		if len(parts) == 3 {
+			part = parts[i]
+		}
+		value, errGo := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if errGo != nil {
+			return values, errors.Wrap(errGo).With("value", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// validate checks that the settings are within their valid ranges
+//
+func (cfg *ColorConfig) validate() (err errors.Error) {
+	for i := range cfg.Gamma {
+		if cfg.Gamma[i] <= 0 || cfg.Gamma[i] > 5 {
+			return errors.New("gamma must be greater than 0 and no more than 5").With("gamma", cfg.Gamma).With("stack", stack.Trace().TrimRuntime())
+		}
+		if cfg.WhitePoint[i] < 0 || cfg.WhitePoint[i] > 1 {
+			return errors.New("white point values must be between 0 and 1").With("whitepoint", cfg.WhitePoint).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if cfg.Brightness < 0 || cfg.Brightness > 1 {
+		return errors.New("brightness must be between 0 and 1").With("brightness", cfg.Brightness).With("stack", stack.Trace().TrimRuntime())
+	}
+	if cfg.MaxCurrent < 0 {
+		return errors.New("the maximum current cannot be negative").With("current", cfg.MaxCurrent).With("stack", stack.Trace().TrimRuntime())
+	}
+	if cfg.MaxCurrent > 0 && cfg.ChannelCurrent <= 0 {
+		return errors.New("the per channel current must be positive when a maximum current is used").With("current", cfg.ChannelCurrent).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// colorPipeline applies a color configuration to frames
+//
+type colorPipeline struct {
+	lut [3][256]uint8
+
+	// The budget is held as the sum of the channel levels that the supply can
+	// drive, 255 being a single channel at full brightness
+	budget float64
+}
+
+func newColorPipeline(cfg ColorConfig) (pipe *colorPipeline, err errors.Error) {
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	pipe = &colorPipeline{}
+
+	for channel := range pipe.lut {
+		scale := cfg.WhitePoint[channel] * cfg.Brightness
+		for level := range pipe.lut[channel] {
+			value := math.Pow(float64(level)/255.0, cfg.Gamma[channel]) * scale
+			pipe.lut[channel][level] = uint8(math.Floor(value*255.0 + 0.5))
+		}
+	}
+
+	if cfg.MaxCurrent > 0 {
+		pipe.budget = cfg.MaxCurrent * 1000.0 / cfg.ChannelCurrent * 255.0
+	}
+	return pipe, nil
+}
+
+// toRGB converts a pixel into 8 bit red, green, and blue values before correction
+//
+func toRGB(pixel color.RGBA) (r uint8, g uint8, b uint8) {
+	// The animation produces opaque colors, a fully transparent pixel is
+	// treated as being off
+	if pixel.A == 0 {
+		return 0, 0, 0
+	}
+	return pixel.R, pixel.G, pixel.B
+}
+
+// correct converts the strands of a frame into corrected 8 bit RGB values, three
+// bytes per pixel, scaling the whole frame down if it exceeds the power budget
+//
+func (pipe *colorPipeline) correct(strands [][]color.RGBA) (rgb [][]byte) {
+
+	rgb = make([][]byte, len(strands))
+	total := 0.0
+
+	for i, pixels := range strands {
+		rgb[i] = make([]byte, len(pixels)*3)
+		for j, pixel := range pixels {
+			r, g, b := toRGB(pixel)
+			rgb[i][j*3] = pipe.lut[0][r]
+			rgb[i][j*3+1] = pipe.lut[1][g]
+			rgb[i][j*3+2] = pipe.lut[2][b]
+			total += float64(rgb[i][j*3]) + float64(rgb[i][j*3+1]) + float64(rgb[i][j*3+2])
+		}
+	}
+
+	if pipe.budget == 0 || total <= pipe.budget {
+		return rgb
+	}
+
+	// The LEDs use PWM so the current drawn is proportional to the corrected
+	// level, scaling every level by the same amount keeps the hues intact
+	scale := pipe.budget / total
+	for _, strand := range rgb {
+		for i, level := range strand {
+			strand[i] = uint8(float64(level) * scale)
+		}
+	}
+	return rgb
+}
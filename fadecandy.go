@@ -1,14 +1,17 @@
 package mawt
 
 // This file contains a function that when started will listen for status
-// messages for the home portal and will update a data structure that another
-// function checks for on a regular basis and uses to update LEDs etc attached
+// messages for the home portal and will pass each change in the status on to
+// the goroutine that renders the animation used to update LEDs etc attached
 // to one or more fadecandy device(s)
 
 import (
 	"bytes"
+	"context"
+	"expvar"
 	"fmt"
-	"os"
+	"image/color"
+	"net/http"
 	"sync"
 	"time"
 
@@ -17,112 +20,472 @@ import (
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 
-	"github.com/cnf/structhash"
-
 	"github.com/kellydunn/go-opc"
 )
 
-var (
-	updating sync.Mutex
-)
+// statusUpdate carries a change in the home portal to the renderer, either a new
+// status or a change in its health
+//
+type statusUpdate struct {
+	url      string
+	seq      uint64
+	injected bool // Supplied by an operator, the seq is that of the last status from the tecthulhu
+	status   *model.Status
+	health   model.HealthState
+}
+
+type FadeCandy struct {
+	router *opcRouter
+	colors *colorPipeline
+	mapper *strandMapper
+	nop    bool // Used to set the server into a test mode with no fcserver present
+
+	previous   map[uint8][]byte // The last data sent for each OPC channel
+	keyframe   time.Time        // When every strand was last sent
+	generation uint64           // Changes when the fadecandy servers are reconnected
+
+	recorder *FrameRecorder   // Records the frames drawn by the animation, nil when not recording
+	regional *regionalOverlay // Draws the other portals over the animation, nil when not used
+	blank    bool             // Set while an operator has blanked the LEDs, used only by the renderer
+
+	controlC chan *ledControl // Operator actions, see fadecandy_control.go
+	status   LEDStatus        // What the renderer is showing, guarded by the mutex
+
+	viewer      *frameViewer // Browsers watching the LEDs, see viewer.go
+	renderStats *expvar.Map  // Counts the frames rendered, and those that were late or dropped
+	opcStats    *expvar.Map  // Counts the frames, strands, writes, and bytes sent to the servers
+
+	doneC chan struct{} // Closed once the goroutines driving the LEDs have stopped
 
-type LastStatus struct {
-	status *model.Status
 	sync.Mutex
 }
 
-type FadeCandy struct {
-	oc  *opc.Client
-	nop bool // Used to set the server into a test mode with no fcserver present
+// LEDConfig contains the settings used to drive the LEDs
+//
+type LEDConfig struct {
+	Server string      // The OPC server, or channel routes, see opc_routes.go, /dev/null if none is present
+	Layout *Layout     // The physical layout of the LEDs, nil for one universe per strand
+	Colors ColorConfig // The color correction applied to frames
+	FPS    float64     // The target number of frames rendered each second
+	Debug  bool        // Display the LED strands on the terminal
+	Record string      // A file into which the frames are recorded, see recording.go, empty for none
+
+	Regional RegionalConfig // How the portals other than the home portal are shown, see regional.go
+}
+
+// DefaultLEDConfig returns the LED settings used when none are supplied
+//
+func DefaultLEDConfig() (cfg LEDConfig) {
+	return LEDConfig{
+		Server: "127.0.0.1:7890",
+		Colors: DefaultColorConfig(),
+		FPS:    33,
+
+		Regional: DefaultRegionalConfig(),
+	}
+}
+
+const (
+	// How often every strand is sent regardless of whether it has changed
+	opcKeyframeInterval = time.Duration(time.Second)
+
+	// The number of home portal changes that can be waiting for the renderer
+	statusBacklog = 16
+
+	// How often late and dropped frames are reported
+	renderReportInterval = time.Duration(30 * time.Second)
+)
+
+// newFadeCandy prepares the color correction, strand mapping, and OPC servers used to
+// drive the LEDs, the layout is checked against a sample of the frames that will be shown
+//
+func newFadeCandy(cfg LEDConfig, sample []animationModel.ChannelData) (fc *FadeCandy, err errors.Error) {
+
+	fc = &FadeCandy{
+		nop:      cfg.Server == "/dev/null",
+		previous: map[uint8][]byte{},
+		controlC: make(chan *ledControl),
+		status: LEDStatus{
+			Sequence: SequenceWaiting,
+			Health:   model.HealthConnecting,
+		},
+		doneC: make(chan struct{}),
+
+		viewer:      newFrameViewer(),
+		renderStats: new(expvar.Map).Init(),
+		opcStats:    new(expvar.Map).Init(),
+	}
+
+	if fc.colors, err = newColorPipeline(cfg.Colors); err != nil {
+		return nil, err
+	}
+
+	// Check that the physical layout matches the frames before anything is sent
+	// to the LEDs
+	layout := cfg.Layout
+	if layout == nil {
+		layout = DefaultLayout()
+	}
+	if err = layout.Validate(sample); err != nil {
+		return nil, err
+	}
+	if fc.mapper, err = newStrandMapper(layout); err != nil {
+		return nil, err
+	}
+
+	// The server can be a single OPC server, or a list of channel ranges and the
+	// servers they are sent to, see opc_routes.go
+	if !fc.nop {
+		if fc.router, err = newOPCRouter(cfg.Server, fc.opcStats); err != nil {
+			return nil, err
+		}
+	}
+	return fc, nil
 }
 
 // This file contains the implementation of a listener for tecthulhu events that will on
 // a regular basis lift the last known state of the portal and will update the fade-candy as needed
 
-func StartFadeCandy(server string, subscribeC chan chan *model.PortalMsg, debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) (fc *FadeCandy) {
+func StartFadeCandy(cfg LEDConfig, fanout *FanOut, errorC chan<- errors.Error, quitC <-chan struct{}) (fc *FadeCandy, err errors.Error) {
+
+	if cfg.FPS <= 0 || cfg.FPS > 1000 {
+		return nil, errors.New("the LED frame rate must be greater than 0, and no more than 1000").With("fps", cfg.FPS).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	sample := NewSink().GetFrame(time.Now())
+	if fc, err = newFadeCandy(cfg, sample); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Regional.Pixels) != 0 || cfg.Regional.Accent > 0 {
+		if fc.regional, err = newRegionalOverlay(cfg.Regional, sample); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.Record) != 0 {
+		if fc.recorder, err = NewFrameRecorder(cfg.Record); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every change to the home portal is passed to the renderer, in order, so that
+	// none are skipped when they arrive close together
+	updateC := make(chan *statusUpdate, statusBacklog)
 
-	statusC := make(chan *model.PortalMsg, 1)
-	subscribeC <- statusC
+	ctx, unsubscribe := context.WithCancel(context.Background())
+	sub := fanout.Subscribe(ctx, "leds", Filter{Topics: []Topic{TopicStatus, TopicHealth}, HomeOnly: true},
+		Queue{Size: statusBacklog, Policy: DropOldest})
 
-	status := &LastStatus{}
+	// The goroutines are tracked so that the doneC can be closed once
+	// they have all stopped
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
 
 	go func() {
-		defer close(statusC)
+		defer wg.Done()
+		defer unsubscribe()
+
+		url, seq := "", uint64(0)
+
 		for {
+			update := (*statusUpdate)(nil)
+
 			select {
-			case msg := <-statusC:
-				if nil == msg {
-					continue
-				}
-				if msg.Home {
-					status.Lock()
-					status.status = msg.Status.DeepCopy()
-					status.Unlock()
+			case msg := <-sub.C:
+				switch msg.Topic {
+				case TopicStatus:
+					// Statuses are published after every check of the portal, only
+					// those carrying a change in the portal are of interest
+					if !msg.Status.Injected && msg.Status.URL == url && msg.Status.Seq == seq {
+						continue
+					}
+					url, seq = msg.Status.URL, msg.Status.Seq
+
+					// An injected status is always shown, and is only shown until the
+					// next status from the tecthulhu
+					if msg.Status.Injected {
+						url, seq = "", 0
+					}
+					update = &statusUpdate{
+						url:      msg.Status.URL,
+						seq:      msg.Status.Seq,
+						injected: msg.Status.Injected,
+						status:   msg.Status.Status.DeepCopy(),
+					}
+				case TopicHealth:
+					update = &statusUpdate{
+						url:    msg.Health.URL,
+						health: msg.Health.State,
+					}
 				}
 			case <-quitC:
 				return
 			}
+
+			select {
+			case updateC <- update:
+			case <-quitC:
+				return
+			}
 		}
 	}()
 
-	fc = &FadeCandy{
-		nop: server == "/dev/null",
+	// Changes to every portal are passed to the regional overlay when it is in use
+	regionC := make(chan *regionalUpdate, statusBacklog)
+	if fc.regional != nil {
+		// Statuses are not coalesced as that could hide a portal changing faction
+		ctx, unsubscribe := context.WithCancel(context.Background())
+		sub := fanout.Subscribe(ctx, "regional", Filter{Topics: []Topic{TopicStatus, TopicHealth}},
+			Queue{Size: statusBacklog, Policy: DropOldest})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer unsubscribe()
+			watchRegion(sub, regionC, quitC)
+		}()
 	}
 
-	go fc.run(status, server, time.Duration(200*time.Millisecond), debug, errorC, quitC)
+	go func() {
+		defer wg.Done()
+		fc.run(updateC, regionC, newFrameClock(cfg.FPS, time.Now(), fc.renderStats), cfg.Debug, errorC, quitC)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(fc.doneC)
+	}()
+
+	return fc, nil
+}
 
-	return fc
+// Viewer returns the handler serving the browser based LED viewer, see viewer.go,
+// which expects to be mounted at /leds/
+//
+func (fc *FadeCandy) Viewer() (handler http.Handler) {
+	return fc.viewer
 }
 
-func (fc *FadeCandy) run(status *LastStatus, server string, refresh time.Duration,
-	debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) {
+// RenderVars returns the counts of the frames rendered, and of those that were late
+// or dropped, for publishing using expvar
+//
+func (fc *FadeCandy) RenderVars() (vars expvar.Var) {
+	return fc.renderStats
+}
 
-	last := []byte{}
+// OPCVars returns the counts of the frames, strands, writes, and bytes sent to the
+// fadecandy servers, for publishing using expvar
+//
+func (fc *FadeCandy) OPCVars() (vars expvar.Var) {
+	return fc.opcStats
+}
 
-	if !fc.nop {
-		if fc.oc == nil {
-			fc.oc = opc.NewClient()
-		}
+// Done returns a channel that is closed once the LEDs are no longer being driven,
+// after the quitC passed to StartFadeCandy has been closed
+//
+func (fc *FadeCandy) Done() (doneC <-chan struct{}) {
+	return fc.doneC
+}
 
-		if errGo := fc.oc.Connect("tcp", server); errGo != nil {
+// frameClock schedules frames at a fixed rate and keeps count of frames that start
+// late, and of those that were dropped because rendering fell a whole frame behind
+//
+type frameClock struct {
+	period time.Duration
+	next   time.Time
 
-			fc.oc = nil
+	late    uint64
+	dropped uint64
 
-			err := errors.Wrap(errGo).With("url", server).With("stack", stack.Trace().TrimRuntime())
+	stats *expvar.Map
+}
 
-			select {
-			case errorC <- err:
-			case <-time.After(100 * time.Millisecond):
-				fmt.Fprintln(os.Stderr, err.Error())
+func newFrameClock(fps float64, now time.Time, stats *expvar.Map) (clock *frameClock) {
+	return &frameClock{
+		period: time.Duration(float64(time.Second) / fps),
+		next:   now,
+		stats:  stats,
+	}
+}
+
+// until returns the time remaining before the next frame is due
+//
+func (clock *frameClock) until(now time.Time) (wait time.Duration) {
+	if wait = clock.next.Sub(now); wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// tick is called as each frame starts and advances the schedule, skipping over any
+// frames that can no longer be rendered on time
+//
+func (clock *frameClock) tick(now time.Time) {
+	behind := now.Sub(clock.next)
+	if behind > clock.period/2 {
+		clock.late++
+		clock.stats.Add("late", 1)
+	}
+	if behind >= clock.period {
+		missed := behind / clock.period
+		clock.dropped += uint64(missed)
+		clock.stats.Add("dropped", int64(missed))
+		clock.next = clock.next.Add(missed * clock.period)
+	}
+	clock.next = clock.next.Add(clock.period)
+	clock.stats.Add("frames", 1)
+}
+
+// watchRegion passes the factions and health of all of the portals to the renderer
+//
+func watchRegion(sub *Subscription, regionC chan<- *regionalUpdate, quitC <-chan struct{}) {
+
+	factions := map[string]string{}
+
+	for {
+		update := (*regionalUpdate)(nil)
+
+		select {
+		case msg := <-sub.C:
+			switch msg.Topic {
+			case TopicStatus:
+				// Only changes of faction are of interest
+				if factions[msg.URL] == msg.Status.Status.Faction {
+					continue
+				}
+				factions[msg.URL] = msg.Status.Status.Faction
+				update = &regionalUpdate{
+					url:     msg.URL,
+					home:    msg.Home,
+					faction: msg.Status.Status.Faction,
+				}
+			case TopicHealth:
+				update = &regionalUpdate{
+					url:    msg.URL,
+					home:   msg.Home,
+					health: msg.Health.State,
+				}
 			}
+		case <-quitC:
+			return
 		}
+
+		select {
+		case regionC <- update:
+		case <-quitC:
+			return
+		}
+	}
+}
+
+// run is the single goroutine that owns the animation, it renders frames when the clock
+// says they are due and, in between, applies changes to the home portal as they arrive
+//
+func (fc *FadeCandy) run(updateC <-chan *statusUpdate, regionC <-chan *regionalUpdate, clock *frameClock, debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) {
+
+	// The connections to the fadecandy servers are made, and remade, in the background
+	if !fc.nop {
+		fc.router.run(errorC, quitC)
 	}
 
+	defer fc.stopRecording(errorC)
+
 	sink := NewSink()
 
-	for {
-		// Start the LED command message pusher
-		go fc.RunLoop(sink, debug, errorC, quitC)
+	frameTimer := time.NewTimer(clock.until(time.Now()))
+	defer frameTimer.Stop()
+
+	reportTick := time.NewTicker(renderReportInterval)
+	defer reportTick.Stop()
 
-		tick := time.NewTicker(refresh)
-		defer tick.Stop()
+	reportedLate, reportedDropped := uint64(0), uint64(0)
 
+	lastURL, lastSeq := "", uint64(0)
+
+	// The last status and health of the home portal are retained so that they can
+	// be restored once an operator stops forcing the animation
+	current := (*model.Status)(nil)
+	health := model.HealthConnecting
+	forced := ""
+
+	for {
 		select {
-		case <-tick.C:
-			status.Lock()
-			copied := status.status.DeepCopy()
-			status.Unlock()
+		case <-frameTimer.C:
+			now := time.Now()
+			clock.tick(now)
 
-			// Portal status not yet available
-			if copied.Faction == "" {
+			fc.render(sink, now, debug, errorC)
+
+			frameTimer.Reset(clock.until(time.Now()))
+
+		case update := <-updateC:
+			if update.status == nil {
+				// When the home portal stops answering the LEDs are switched
+				// to a distinct pattern rather than freezing on the last state
+				health = update.health
+				if len(forced) == 0 {
+					sink.UpdateHealth(health)
+				}
+				fc.report(func(status *LEDStatus) {
+					status.Health = health
+				})
 				continue
 			}
 
-			hash := structhash.Md5(copied, 1)
-			if bytes.Compare(last, hash) != 0 {
-				last = hash
-				sink.UpdateStatus(copied)
+			// A gap in the sequence means a change in the portal was lost before
+			// reaching the renderer, normally due to the fan-out being congested.
+			// Injected statuses are not part of the sequence.
+			if !update.injected {
+				if update.url == lastURL && update.seq > lastSeq+1 {
+					sendErr(errorC, errors.New("home portal status changes were missed").
+						With("url", update.url).With("missed", update.seq-lastSeq-1).With("stack", stack.Trace().TrimRuntime()))
+				}
+				lastURL, lastSeq = update.url, update.seq
+			}
+
+			current = update.status
+			if len(forced) == 0 {
+				sink.UpdateStatus(current)
 			}
+			fc.report(func(status *LEDStatus) {
+				status.URL = update.url
+				status.Seq = update.seq
+				status.Faction = current.Faction
+				status.Level = current.Level
+			})
+
+		case ctl := <-fc.controlC:
+			if ctl.blank != nil {
+				fc.blank = *ctl.blank
+			}
+			if ctl.force != nil && *ctl.force != forced {
+				forced = *ctl.force
+				if len(forced) != 0 {
+					// A forced animation is shown even while the home portal is offline
+					sink.UpdateHealth(model.HealthOnline)
+					sink.UpdateStatus(forcedStatus(current, forced))
+				} else {
+					sink.UpdateHealth(health)
+					sink.UpdateStatus(forcedStatus(current, ""))
+				}
+			}
+			fc.report(func(status *LEDStatus) {
+				status.Forced = forced
+				status.Blank = fc.blank
+			})
+
+		case update := <-regionC:
+			fc.regional.update(update, time.Now())
+
+		case <-reportTick.C:
+			if clock.late != reportedLate || clock.dropped != reportedDropped {
+				sendErr(errorC, errors.New("LED frames could not be rendered on time").
+					With("late", clock.late-reportedLate).With("dropped", clock.dropped-reportedDropped).
+					With("interval", renderReportInterval.String()).With("stack", stack.Trace().TrimRuntime()))
+				reportedLate, reportedDropped = clock.late, clock.dropped
+			}
+
 		case <-quitC:
 			return
 		}
@@ -133,72 +496,61 @@ func (fc *FadeCandy) Send(m *opc.Message) (err errors.Error) {
 	if fc.nop {
 		return nil
 	}
-	if fc.oc == nil {
-		return errors.New("fadecandy server not online").With("stack", stack.Trace().TrimRuntime())
-	}
+	return fc.router.Send(m)
+}
 
-	if m == nil {
-		return errors.New("invalid message").With("stack", stack.Trace().TrimRuntime())
-	}
+// render draws a frame of the animation and sends it to the LEDs
+//
+func (fc *FadeCandy) render(sink *statusSink, tm time.Time, debug bool, errorC chan<- errors.Error) {
+	// Populate the logical buffers
+	frameData := sink.GetFrame(tm)
 
-	if errGo := fc.oc.Send(m); errGo != nil {
-		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	if fc.regional != nil {
+		frameData = fc.regional.apply(tm, frameData)
 	}
-	return nil
-}
 
-func (fc *FadeCandy) RunLoop(sink *statusSink, debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	if fc.blank {
+		frameData = blankFrame(frameData)
+	}
 
-	defer close(errorC)
+	if fc.recorder != nil {
+		if err := fc.recorder.Record(tm, frameData); err != nil {
+			sendErr(errorC, err)
+			fc.stopRecording(errorC)
+		}
+	}
 
-	refresh := time.Duration(30 * time.Millisecond)
-	tick := time.NewTicker(refresh)
-	defer tick.Stop()
+	fc.show(tm, frameData, debug, errorC)
+}
 
-	opcError := errors.New("")
+// show sends a frame, of logical universes, to the LEDs
+//
+func (fc *FadeCandy) show(tm time.Time, frameData []animationModel.ChannelData, debug bool, errorC chan<- errors.Error) {
+	// Browsers watching the LEDs, see viewer.go, are shown the logical frame
+	if fc.viewer.watching() {
+		fc.viewer.publish(tm, frameData)
+	}
 
-	for {
-		select {
-		case <-tick.C:
-			updating.Lock()
-			// Populate the logical buffers
-			frameData := sink.GetFrame(time.Now())
-
-			// Copy the logical buffers into the physical buffers
-
-			// for _, id := range universes {
-			// 	if errGo := devices.UpdateUniverse(id, sr.UniverseData(id)); errGo != nil {
-			// 		sendErr(errorC, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
-			// 	}
-			// }
-			//
-			// // Iterate across physical strands sending updates to the
-			// // FadeCandies, possibly diffing to previous frame to see if necessary
-			// deviceStrands, errGo := GetStrands()
-			// if errGo != nil {
-			// 	sendErr(errorC, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
-			// 	updating.Unlock()
-			// 	continue
-			// }
-
-			newRefresh := refresh
-			if opcError = fc.updateStrands(frameData, debug, errorC); opcError != nil {
-				newRefresh = time.Duration(250 * time.Millisecond)
-			} else {
-				newRefresh = time.Duration(30 * time.Millisecond)
-			}
-			updating.Unlock()
+	// Copy the logical buffers into the physical buffers
+	strands, err := fc.mapper.strands(frameData)
+	if err != nil {
+		sendErr(errorC, err)
+		return
+	}
 
-			if newRefresh != refresh {
-				refresh = newRefresh
-				tick.Stop()
-				tick = time.NewTicker(refresh)
-			}
+	fc.updateStrands(strands, debug, errorC)
+}
 
-		case <-quitC:
-			return
-		}
+// stopRecording closes the recording file, if frames are being recorded
+//
+func (fc *FadeCandy) stopRecording(errorC chan<- errors.Error) {
+	if fc.recorder == nil {
+		return
 	}
+	if err := fc.recorder.Close(); err != nil {
+		sendErr(errorC, err)
+	}
+	fc.recorder = nil
 }
 
 var (
@@ -217,38 +569,83 @@ var (
 	}
 )
 
+// updateStrands sends those strands that have changed since the previous frame to
+// the fadecandy servers using a single write per server.  Every strand is sent
+// periodically, and after a server is reconnected, to recover from any losses.
+//
 func (fc *FadeCandy) updateStrands(data []animationModel.ChannelData, debug bool, errorC chan<- errors.Error) (err errors.Error) {
 	if debug {
 		headingOnce.Do(onceBody)
 		fmt.Printf("\x1b[3;0H")
 	}
-	for _, channelData := range data {
+	strands := make([][]color.RGBA, len(data))
+	for i, channelData := range data {
+		strands[i] = channelData.Data
+	}
+	corrected := fc.colors.correct(strands)
+
+	now := time.Now()
+	keyframe := now.Sub(fc.keyframe) >= opcKeyframeInterval
+	if !fc.nop {
+		if generation := fc.router.generation(); generation != fc.generation {
+			fc.generation = generation
+			keyframe = true
+		}
+	}
+	if keyframe {
+		fc.keyframe = now
+		fc.opcStats.Add("keyframes", 1)
+	}
+	fc.opcStats.Add("frames", 1)
+
+	msgs := make([][]byte, 0, len(data))
+
+	for i, channelData := range data {
 		// The OPC protocol assigns a channel per LED strand, and supports a maximum of
 		// 255 strands per server.  Channel 0 is a broadcast channel.
 		channel := uint8(channelData.ChannelNum)
-		strip := fmt.Sprintf("\x1b[%d;0H%02d → ", channel+3, channel)
 
-		// Prepare a message for this strand that has 3 bytes per LED
-		m := opc.NewMessage(channel)
-		m.SetLength(uint16(len(channelData.Data) * 3))
-		for i, rgba := range channelData.Data {
-			r, g, b, a := rgba.RGBA()
-			if a == 0 {
-				r = 0
-				g = 0
-				b = 0
-			}
-			strip += fmt.Sprintf("\x1b[38;2;%d;%d;%dm█\x1b[0m", uint8(r), uint8(g), uint8(b))
-			m.SetPixelColor(i, uint8(r), uint8(g), uint8(b))
-		}
-		if err = fc.Send(m); err != nil {
-			sendErr(errorC, err)
+		rgb := corrected[i]
+		if !keyframe && bytes.Equal(fc.previous[channel], rgb) {
+			fc.opcStats.Add("strandsSkipped", 1)
+			continue
 		}
+		fc.previous[channel] = rgb
+		fc.opcStats.Add("strandsSent", 1)
+
+		// Prepare a message for this strand that has 3 bytes per LED
+		msgs = append(msgs, encodeOPC(channel, rgb))
+
 		if debug {
+			strip := fmt.Sprintf("\x1b[%d;0H%02d → ", channel+3, channel)
+			for pixel := 0; pixel < len(rgb)/3; pixel++ {
+				strip += fmt.Sprintf("\x1b[38;2;%d;%d;%dm█\x1b[0m", rgb[pixel*3], rgb[pixel*3+1], rgb[pixel*3+2])
+			}
 			fmt.Println(strip)
 			fmt.Printf("\x1b[32;0H")
 		}
 	}
+
+	if fc.nop || len(msgs) == 0 {
+		return nil
+	}
+
+	failed, err := fc.router.SendBatch(msgs)
+	if err != nil {
+		// Strands that did not arrive need to be sent again with the next frame,
+		// those sent to the other servers are unaffected
+		for channel := range fc.previous {
+			if failed[fc.router.route(channel)] || (channel == opc.BROADCAST_CHANNEL && len(failed) != 0) {
+				delete(fc.previous, channel)
+			}
+		}
+
+		// The links report on connections going offline so there
+		// is no need to repeat that for every frame
+		if errors.Cause(err) != ErrOPCOffline {
+			sendErr(errorC, err)
+		}
+	}
 	return err
 }
 
@@ -0,0 +1,184 @@
+package mawt
+
+// This module allows operators to see, and override, what is being shown on
+// the LEDs.  The animation for a faction can be forced regardless of the state
+// of the home portal, and the LEDs can be blanked, for example while the
+// installation is being worked on.  Both are applied by the goroutine that
+// renders the frames, see fadecandy.go, which also keeps the LEDStatus
+// up to date.
+
+import (
+	"image/color"
+	"sort"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// The animation sequences that can be reported in the LEDStatus
+//
+const (
+	SequenceWaiting     = "waiting"     // No status has been received for the home portal
+	SequenceNeutral     = "neutral"     // The home portal is neutral
+	SequenceEnlightened = "enlightened" // The home portal is held by the Enlightened
+	SequenceResistance  = "resistance"  // The home portal is held by the Resistance
+	SequenceSignalLost  = "signal-lost" // The home portal cannot be reached
+	SequenceBlank       = "blank"       // The LEDs have been blanked by an operator
+
+	// How long an operator action waits for the renderer to accept it
+	ledControlTimeout = time.Duration(750 * time.Millisecond)
+)
+
+// OPCServerStatus describes the connection to one of the fadecandy servers
+//
+type OPCServerStatus struct {
+	Server   string `json:"server"`
+	Online   bool   `json:"online"`
+	Connects uint64 `json:"connects"` // The number of times a connection has been made
+}
+
+// LEDStatus describes what is being shown on the LEDs
+//
+type LEDStatus struct {
+	Sequence string            `json:"sequence"`         // The animation being played, one of the Sequence values
+	URL      string            `json:"url"`              // The home portal the animation was last updated from
+	Seq      uint64            `json:"seq"`              // The sequence number of the last status shown
+	Faction  string            `json:"faction"`          // The faction of the home portal
+	Level    float32           `json:"level"`            // The level of the home portal
+	Health   model.HealthState `json:"health"`           // The health of the home portal
+	Forced   string            `json:"forced,omitempty"` // The faction forced by an operator
+	Blank    bool              `json:"blank"`
+	Servers  []OPCServerStatus `json:"servers"`
+}
+
+// ledControl is an operator action, fields left nil are unchanged
+//
+type ledControl struct {
+	force *string // The faction to be shown, empty to follow the home portal again
+	blank *bool
+}
+
+// Status returns what is being shown on the LEDs along with the state of the
+// connections to the fadecandy servers
+//
+func (fc *FadeCandy) Status() (status LEDStatus) {
+	fc.Lock()
+	status = fc.status
+	fc.Unlock()
+
+	status.Servers = []OPCServerStatus{}
+	if fc.router != nil {
+		for server, link := range fc.router.links {
+			status.Servers = append(status.Servers, OPCServerStatus{
+				Server:   server,
+				Online:   link.online(),
+				Connects: link.generation(),
+			})
+		}
+		sort.Slice(status.Servers, func(i, j int) bool {
+			return status.Servers[i].Server < status.Servers[j].Server
+		})
+	}
+	return status
+}
+
+// Force shows the animation for a faction, E, R, or N, regardless of the state of
+// the home portal.  An empty faction returns the LEDs to following the home portal.
+//
+func (fc *FadeCandy) Force(faction string) (err errors.Error) {
+	if len(faction) != 0 {
+		code, isKnown := FactionCode(faction)
+		if !isKnown {
+			return errors.New("unknown faction").With("faction", faction).With("stack", stack.Trace().TrimRuntime())
+		}
+		faction = code
+	}
+	return fc.control(&ledControl{force: &faction})
+}
+
+// Blank turns off, or restores, the LEDs.  The animation continues to follow the
+// home portal while the LEDs are blank.
+//
+func (fc *FadeCandy) Blank(blank bool) (err errors.Error) {
+	return fc.control(&ledControl{blank: &blank})
+}
+
+func (fc *FadeCandy) control(ctl *ledControl) (err errors.Error) {
+	select {
+	case fc.controlC <- ctl:
+		return nil
+	case <-fc.doneC:
+	case <-time.After(ledControlTimeout):
+	}
+	return errors.New("the LEDs are not running").With("stack", stack.Trace().TrimRuntime())
+}
+
+// report is used by the renderer to change the LEDStatus, the sequence is derived
+// from the other fields once they have been changed
+//
+func (fc *FadeCandy) report(change func(status *LEDStatus)) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	change(&fc.status)
+
+	faction := fc.status.Faction
+	if len(fc.status.Forced) != 0 {
+		faction = fc.status.Forced
+	}
+
+	switch {
+	case fc.status.Blank:
+		fc.status.Sequence = SequenceBlank
+	case len(fc.status.Forced) == 0 && fc.status.Health == model.HealthOffline:
+		fc.status.Sequence = SequenceSignalLost
+	case faction == "E":
+		fc.status.Sequence = SequenceEnlightened
+	case faction == "R":
+		fc.status.Sequence = SequenceResistance
+	case faction == "N":
+		fc.status.Sequence = SequenceNeutral
+	default:
+		fc.status.Sequence = SequenceWaiting
+	}
+}
+
+// forcedStatus returns the status given to the animation when a faction is forced,
+// the home portal status with its faction replaced.  An empty faction returns the
+// home portal status, or a neutral portal if none has been seen.
+//
+func forcedStatus(current *model.Status, faction string) (status *model.Status) {
+	status = &model.Status{Faction: "N"}
+	if current != nil {
+		status = current.DeepCopy()
+	}
+	if len(faction) == 0 {
+		return status
+	}
+
+	status.Faction = faction
+	// The animation for a held portal cycles more slowly at higher levels, and
+	// does not hold the windows lit at all for a level 0 portal
+	if faction != "N" && status.Level < 1 {
+		status.Level = 1
+	}
+	return status
+}
+
+// blankFrame returns a frame of the same shape with every pixel turned off
+//
+func blankFrame(frame []animationModel.ChannelData) (blank []animationModel.ChannelData) {
+	blank = make([]animationModel.ChannelData, len(frame))
+	for i, channel := range frame {
+		blank[i].ChannelNum = channel.ChannelNum
+		blank[i].Data = make([]color.RGBA, len(channel.Data))
+		for pixel := range blank[i].Data {
+			blank[i].Data[pixel].A = 0xff
+		}
+	}
+	return blank
+}
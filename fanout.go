@@ -1,73 +1,534 @@
 package mawt
 
+// This module implements the fan-out used by a Gateway to broadcast the
+// messages describing the tecthulhus to the components that act upon them,
+// the LEDs, sound effects, and monitoring.
+//
+// Messages are published on one of several topics, see Topic, and are
+// delivered to those subscribers whose Filter they match.  Subscriptions end
+// when the context supplied to Subscribe is cancelled.  Each Gateway has its
+// own fan-out so that several can be run within a single process.
+//
+// The fan-out also decides which tecthulhu is the home portal, see home.go,
+// and marks the messages concerning it as they are delivered.
+//
+// Every subscriber has its own bounded queue, and goroutine delivering from
+// it, so that a slow subscriber does not hold up the others.  What happens
+// when the queue is full is declared by the subscriber using a QueuePolicy.
+// The counts of messages delivered, dropped, and coalesced, for each
+// subscriber are kept in an expvar.Map that the application can publish,
+// see Vars.
+
 import (
-	"fmt"
+	"context"
+	"expvar"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/TeamNorCal/mawt/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
 )
 
-var (
-	subs = &Subs{
-		subs: []chan *model.PortalMsg{},
-	}
+// Topic identifies the kind of message being published
+//
+type Topic string
+
+const (
+	TopicStatus Topic = "status" // The Status of a Message is populated after every check of a tecthulhu
+	TopicEvents Topic = "events" // The Event of a Message is populated with a change detected between statuses
+	TopicHealth Topic = "health" // The Health of a Message is populated when the liveness of a tecthulhu changes
+	TopicErrors Topic = "errors" // The Err of a Message is populated when a tecthulhu could not be checked
+	TopicHome   Topic = "home"   // The HomeChange of a Message is populated when the home portal changes
+
+	// How long a publisher waits for the fan-out to accept a message
+	fanOutPublishTimeout = time.Duration(750 * time.Millisecond)
 )
 
-type Subs struct {
-	subs []chan *model.PortalMsg
+// QueuePolicy decides what happens to messages for a subscriber whose queue is full
+//
+type QueuePolicy string
+
+const (
+	// DropOldest discards the oldest queued message to make room for the new one
+	DropOldest QueuePolicy = "drop-oldest"
+
+	// CoalesceLatest replaces a queued status, or health, message with a newer one
+	// for the same tecthulhu, so that only the latest is delivered.  Events and errors
+	// are queued and, when the queue is full, the oldest message is dropped.
+	CoalesceLatest QueuePolicy = "coalesce-latest"
+
+	// Block holds up the fan-out, and so every subscriber, until the subscriber has
+	// room in its queue.  It should only be used by subscribers that never stall.
+	Block QueuePolicy = "block"
+)
+
+// Queue describes the queue of messages waiting for a subscriber
+//
+type Queue struct {
+	Size   int // The number of messages that can be waiting, at least 1
+	Policy QueuePolicy
+}
+
+// Message is what subscribers receive, only the field for the Topic is populated
+//
+type Message struct {
+	Topic Topic
+	URL   string // The tecthulhu the message concerns
+	Home  bool   // Set when the tecthulhu is for the home portal
+
+	Status *model.PortalMsg
+	Event  *model.PortalEvent
+	Health *model.HealthMsg
+	Err    errors.Error
+
+	HomeChange *HomeChange
+}
+
+// Filter selects the messages delivered to a subscriber, fields left empty match
+// every message
+//
+type Filter struct {
+	Topics   []Topic  // The topics of interest
+	URLs     []string // The tecthulhus of interest
+	HomeOnly bool     // Only messages concerning the home portal
+}
+
+func (filter *Filter) matches(msg *Message) (isMatch bool) {
+	if filter.HomeOnly && !msg.Home {
+		return false
+	}
+	if len(filter.Topics) != 0 {
+		isMatch = false
+		for _, topic := range filter.Topics {
+			if topic == msg.Topic {
+				isMatch = true
+				break
+			}
+		}
+		if !isMatch {
+			return false
+		}
+	}
+	if len(filter.URLs) != 0 {
+		isMatch = false
+		for _, url := range filter.URLs {
+			if url == msg.URL {
+				isMatch = true
+				break
+			}
+		}
+		if !isMatch {
+			return false
+		}
+	}
+	return true
+}
+
+// SubscriberStats counts the messages handled for a subscriber
+//
+type SubscriberStats struct {
+	Name      string      `json:"name"`
+	Policy    QueuePolicy `json:"policy"`
+	Queued    int         `json:"queued"`    // Messages waiting to be delivered
+	Delivered uint64      `json:"delivered"` // Messages accepted by the subscriber
+	Dropped   uint64      `json:"dropped"`   // Messages discarded as the queue was full
+	Coalesced uint64      `json:"coalesced"` // Messages replaced by a newer message
+}
+
+// Subscription delivers the messages matching a Filter on its channel, C, which is
+// closed once the subscription has ended
+//
+type Subscription struct {
+	C <-chan *Message
+
+	name   string
+	filter Filter
+	queue  Queue
+	msgC   chan *Message
+	stats  *expvar.Map // The statistics of the fan-out, see FanOut.Vars
+
+	pending []*Message    // Messages waiting to be delivered, oldest first
+	wakeC   chan struct{} // Signals the delivery goroutine that messages are waiting
+	spaceC  chan struct{} // Signals a blocked fan-out that there is room in the queue
+	doneC   chan struct{} // Closed when the subscription ends
+
+	delivered uint64 // Accessed atomically
+	dropped   uint64 // Accessed atomically
+	coalesced uint64 // Accessed atomically
+
 	sync.Mutex
 }
 
-// startFanOut implement a broadcast mechanisim for accepting portal state messages
-// and relaying then to subscribers.  The function returns a single channel
-// to which portal update messages get sent and, a channel that can be used to add
-// listeners
+// Stats returns the counts of messages handled for the subscriber
 //
-func startFanOut(quitC <-chan struct{}) (inC chan *model.PortalMsg, subC chan chan *model.PortalMsg) {
+func (sub *Subscription) Stats() (stats SubscriberStats) {
+	sub.Lock()
+	queued := len(sub.pending)
+	sub.Unlock()
+
+	return SubscriberStats{
+		Name:      sub.name,
+		Policy:    sub.queue.Policy,
+		Queued:    queued,
+		Delivered: atomic.LoadUint64(&sub.delivered),
+		Dropped:   atomic.LoadUint64(&sub.dropped),
+		Coalesced: atomic.LoadUint64(&sub.coalesced),
+	}
+}
 
-	inC = make(chan *model.PortalMsg, 1)
-	subC = make(chan chan *model.PortalMsg, 1)
+// wake signals a goroutine waiting on the channel, if one is not already signalled
+//
+func wake(wakeC chan struct{}) {
+	select {
+	case wakeC <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue adds a message to the queue applying the policy when it is full, only
+// Block subscribers will cause this function to wait
+//
+func (sub *Subscription) enqueue(msg *Message, quitC <-chan struct{}) {
+	for {
+		sub.Lock()
 
-	go func(quitC <-chan struct{}) {
-		defer fmt.Println("fanout stopped")
-		for {
+		select {
+		case <-sub.doneC:
+			sub.Unlock()
+			return
+		default:
+		}
+
+		if sub.queue.Policy == CoalesceLatest && (msg.Topic == TopicStatus || msg.Topic == TopicHealth) {
+			for i, queued := range sub.pending {
+				if queued.Topic == msg.Topic && queued.URL == msg.URL {
+					sub.pending[i] = msg
+					sub.Unlock()
+
+					atomic.AddUint64(&sub.coalesced, 1)
+					sub.stats.Add(sub.name+".coalesced", 1)
+					return
+				}
+			}
+		}
+
+		if len(sub.pending) < sub.queue.Size {
+			sub.pending = append(sub.pending, msg)
+			sub.Unlock()
+			wake(sub.wakeC)
+			return
+		}
+
+		if sub.queue.Policy == Block {
+			sub.Unlock()
 			select {
+			case <-sub.spaceC:
+				continue
+			case <-sub.doneC:
+				return
 			case <-quitC:
 				return
-			case sub := <-subC:
-				if nil != sub {
-					subs.Lock()
-					subs.subs = append(subs.subs, sub)
-					subs.Unlock()
-					fmt.Println("subscription added")
-				}
-			case msg := <-inC:
-				// The subscriptions are notified of a message and are groomed out
-				// on unrecoverable failures using https://github.com/golang/go/wiki/SliceTricks#filtering-without-allocating
-				subs.Lock()
-				newSubs := subs.subs[:0]
-				for _, ch := range subs.subs {
-					func() {
-						defer func() {
-							if r := recover(); r == nil {
-								newSubs = append(newSubs, ch)
-								return
-							}
-							fmt.Println("subscription dropped failed to send")
-						}()
-						select {
-						case ch <- msg:
-						case <-time.After(250 * time.Millisecond):
-							fmt.Println("subscription failed to send")
-						}
-					}()
-				}
-				subs.subs = newSubs
-				subs.Unlock()
 			}
 		}
-	}(quitC)
 
-	return inC, subC
+		sub.pending = append(sub.pending[1:], msg)
+		sub.Unlock()
+
+		atomic.AddUint64(&sub.dropped, 1)
+		sub.stats.Add(sub.name+".dropped", 1)
+		wake(sub.wakeC)
+		return
+	}
+}
+
+// deliver passes the queued messages to the subscriber until the subscription ends
+//
+func (sub *Subscription) deliver() {
+	defer close(sub.msgC)
+
+	for {
+		sub.Lock()
+		if len(sub.pending) == 0 {
+			sub.Unlock()
+			select {
+			case <-sub.wakeC:
+				continue
+			case <-sub.doneC:
+				return
+			}
+		}
+		msg := sub.pending[0]
+		sub.pending[0] = nil
+		sub.pending = sub.pending[1:]
+		sub.Unlock()
+
+		wake(sub.spaceC)
+
+		select {
+		case sub.msgC <- msg:
+			atomic.AddUint64(&sub.delivered, 1)
+			sub.stats.Add(sub.name+".delivered", 1)
+		case <-sub.doneC:
+			return
+		}
+	}
+}
+
+// FanOut broadcasts the messages published to it to the matching subscribers
+//
+type FanOut struct {
+	inC  chan *Message
+	subs []*Subscription
+
+	home    *homeSelector     // Used only by the Run goroutine
+	homeC   chan *homeRequest // Changes to the home portal selection
+	homeURL string            // The current home portal, for use outside of Run
+	policy  HomePolicy
+
+	// stats count the messages delivered, dropped, and coalesced using the
+	// subscriber names
+	stats *expvar.Map
+
+	sync.Mutex
+}
+
+// homeRequest asks the fan-out to change how the home portal is selected
+//
+type homeRequest struct {
+	policy HomePolicy
+	url    string
+	replyC chan errors.Error
+}
+
+// NewFanOut creates a fan-out, messages are only delivered once Run is called
+//
+func NewFanOut(home HomeConfig) (fo *FanOut, err errors.Error) {
+	fo = &FanOut{
+		inC:   make(chan *Message, 1),
+		subs:  []*Subscription{},
+		homeC: make(chan *homeRequest),
+		stats: new(expvar.Map).Init(),
+	}
+	if fo.home, err = newHomeSelector(home); err != nil {
+		return nil, err
+	}
+	fo.homeURL = fo.home.current
+	fo.policy = fo.home.policy
+	return fo, nil
+}
+
+// Home returns the current home portal and the policy used to select it
+//
+func (fo *FanOut) Home() (url string, policy HomePolicy) {
+	fo.Lock()
+	defer fo.Unlock()
+	return fo.homeURL, fo.policy
+}
+
+// SetHomePolicy changes how the home portal is selected, when a url is supplied it
+// becomes the home portal for the fixed policy
+//
+func (fo *FanOut) SetHomePolicy(policy HomePolicy, url string) (err errors.Error) {
+	req := &homeRequest{
+		policy: policy,
+		url:    url,
+		replyC: make(chan errors.Error, 1),
+	}
+	select {
+	case fo.homeC <- req:
+	case <-time.After(fanOutPublishTimeout):
+		return errors.New("the fan-out is not running").With("stack", stack.Trace().TrimRuntime())
+	}
+	return <-req.replyC
+}
+
+// Subscribe adds a subscriber, the name is used to identify it in statistics
+//
+func (fo *FanOut) Subscribe(ctx context.Context, name string, filter Filter, queue Queue) (sub *Subscription) {
+	if queue.Size < 1 {
+		queue.Size = 1
+	}
+	if len(queue.Policy) == 0 {
+		queue.Policy = DropOldest
+	}
+
+	msgC := make(chan *Message)
+	sub = &Subscription{
+		C:       msgC,
+		name:    name,
+		filter:  filter,
+		queue:   queue,
+		msgC:    msgC,
+		stats:   fo.stats,
+		pending: make([]*Message, 0, queue.Size),
+		wakeC:   make(chan struct{}, 1),
+		spaceC:  make(chan struct{}, 1),
+		doneC:   make(chan struct{}),
+	}
+
+	fo.Lock()
+	fo.subs = append(fo.subs, sub)
+	fo.Unlock()
+
+	go sub.deliver()
+
+	go func() {
+		<-ctx.Done()
+
+		fo.Lock()
+		subs := fo.subs[:0]
+		for _, s := range fo.subs {
+			if s != sub {
+				subs = append(subs, s)
+			}
+		}
+		fo.subs = subs
+		fo.Unlock()
+
+		close(sub.doneC)
+	}()
+
+	return sub
+}
+
+// Stats returns the statistics for each of the current subscribers
+//
+func (fo *FanOut) Stats() (stats []SubscriberStats) {
+	fo.Lock()
+	defer fo.Unlock()
+
+	stats = make([]SubscriberStats, 0, len(fo.subs))
+	for _, sub := range fo.subs {
+		stats = append(stats, sub.Stats())
+	}
+	return stats
+}
+
+// Vars returns the counts of messages handled for each subscriber, for publishing using
+// expvar
+//
+func (fo *FanOut) Vars() (vars expvar.Var) {
+	return fo.stats
+}
+
+// PublishStatus broadcasts the status retrieved by a check of a tecthulhu
+//
+func (fo *FanOut) PublishStatus(msg *model.PortalMsg) (err errors.Error) {
+	return fo.publish(&Message{Topic: TopicStatus, URL: msg.URL, Status: msg})
+}
+
+// PublishEvent broadcasts a change detected between the statuses of a tecthulhu
+//
+func (fo *FanOut) PublishEvent(evt *model.PortalEvent) (err errors.Error) {
+	return fo.publish(&Message{Topic: TopicEvents, URL: evt.URL, Event: evt})
+}
+
+// PublishHealth broadcasts a change in the liveness of a tecthulhu
+//
+func (fo *FanOut) PublishHealth(msg *model.HealthMsg) (err errors.Error) {
+	return fo.publish(&Message{Topic: TopicHealth, URL: msg.URL, Health: msg})
+}
+
+// PublishError broadcasts a failure to check a tecthulhu
+//
+func (fo *FanOut) PublishError(url string, failure errors.Error) (err errors.Error) {
+	return fo.publish(&Message{Topic: TopicErrors, URL: url, Err: failure})
+}
+
+func (fo *FanOut) publish(msg *Message) (err errors.Error) {
+	select {
+	case fo.inC <- msg:
+		return nil
+	case <-time.After(fanOutPublishTimeout):
+		return errors.New("portal message dropped").With("topic", msg.Topic).With("url", msg.URL).With("stack", stack.Trace().TrimRuntime())
+	}
+}
+
+// Run delivers the published messages to the subscribers until the quitC is closed
+//
+func (fo *FanOut) Run(quitC <-chan struct{}) {
+	for {
+		select {
+		case <-quitC:
+			return
+		case msg := <-fo.inC:
+			fo.home.observe(msg, time.Now())
+			fo.deliver(msg, quitC)
+			fo.reselect(quitC)
+		case req := <-fo.homeC:
+			err := fo.home.setPolicy(req.policy, req.url)
+			if err == nil {
+				fo.Lock()
+				fo.policy = fo.home.policy
+				fo.Unlock()
+				fo.reselect(quitC)
+			}
+			req.replyC <- err
+		}
+	}
+}
+
+// reselect applies the home portal policy, announcing any change in the home portal
+// and then delivering what is known about the new home portal
+//
+func (fo *FanOut) reselect(quitC <-chan struct{}) {
+	url := fo.home.choose()
+	if url == fo.home.current {
+		return
+	}
+
+	change := &HomeChange{
+		URL:      url,
+		Previous: fo.home.current,
+		Policy:   fo.home.policy,
+	}
+	fo.home.current = url
+
+	fo.Lock()
+	fo.homeURL = url
+	fo.Unlock()
+
+	fo.deliver(&Message{Topic: TopicHome, URL: url, HomeChange: change}, quitC)
+
+	// The messages that were delivered before are copied as they are now for
+	// the home portal
+	portal := fo.home.portals[url]
+	if portal.healthMsg != nil {
+		health := *portal.healthMsg
+		fo.deliver(&Message{Topic: TopicHealth, URL: url, Health: &health}, quitC)
+	}
+	if portal.status != nil {
+		fo.deliver(&Message{Topic: TopicStatus, URL: url, Status: portal.status.DeepCopy()}, quitC)
+	}
+}
+
+// deliver marks a message that concerns the home portal and queues it for the
+// matching subscribers
+//
+func (fo *FanOut) deliver(msg *Message, quitC <-chan struct{}) {
+	msg.Home = len(msg.URL) != 0 && msg.URL == fo.home.current
+	switch {
+	case msg.Status != nil:
+		msg.Status.Home = msg.Home
+	case msg.Event != nil:
+		msg.Event.Home = msg.Home
+	case msg.Health != nil:
+		msg.Health.Home = msg.Home
+	}
+
+	// The subscribers are copied so that a Block subscriber does not prevent
+	// others from subscribing, or unsubscribing, while it is waited upon
+	fo.Lock()
+	subs := make([]*Subscription, len(fo.subs))
+	copy(subs, fo.subs)
+	fo.Unlock()
+
+	for _, sub := range subs {
+		if sub.filter.matches(msg) {
+			sub.enqueue(msg, quitC)
+		}
+	}
 }
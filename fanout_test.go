@@ -0,0 +1,251 @@
+package mawt
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+)
+
+func statusMessage(url string, seq uint64) (msg *Message) {
+	return &Message{Topic: TopicStatus, URL: url, Status: &model.PortalMsg{URL: url, Seq: seq}}
+}
+
+func healthMessage(url string, state model.HealthState) (msg *Message) {
+	return &Message{Topic: TopicHealth, URL: url, Health: &model.HealthMsg{URL: url, State: state}}
+}
+
+func eventMessage(url string) (msg *Message) {
+	return &Message{Topic: TopicEvents, URL: url, Event: &model.PortalEvent{URL: url, Type: model.ResonatorDeployed}}
+}
+
+// describe identifies a message briefly enough for the messages expected by a test
+// to be written out in full
+//
+func describe(msg *Message) (brief string) {
+	switch msg.Topic {
+	case TopicStatus:
+		return fmt.Sprintf("%s %s %d", msg.Topic, msg.URL, msg.Status.Seq)
+	case TopicHealth:
+		return fmt.Sprintf("%s %s %s", msg.Topic, msg.URL, msg.Health.State)
+	case TopicHome:
+		return fmt.Sprintf("%s %s<%s", msg.Topic, msg.URL, msg.HomeChange.Previous)
+	}
+	return fmt.Sprintf("%s %s", msg.Topic, msg.URL)
+}
+
+// waitStats waits for the statistics of the subscription to satisfy the check
+//
+func waitStats(t *testing.T, sub *Subscription, check func(stats SubscriberStats) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if check(sub.Stats()) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("the subscription reached %+v", sub.Stats())
+}
+
+// waitInFlight waits for the single message queued for a subscriber to be taken by the
+// goroutine delivering it, so that the messages that follow remain in the queue
+// until the test reads from the subscription
+//
+func waitInFlight(t *testing.T, sub *Subscription) {
+	waitStats(t, sub, func(stats SubscriberStats) bool { return stats.Queued == 0 })
+}
+
+// receive reads a number of messages from the subscription
+//
+func receive(t *testing.T, sub *Subscription, count int) (got []string) {
+	got = []string{}
+	for len(got) != count {
+		select {
+		case msg, isOpen := <-sub.C:
+			if !isOpen {
+				t.Fatalf("the subscription ended after %q", got)
+			}
+			got = append(got, describe(msg))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %q were received", got)
+		}
+	}
+	return got
+}
+
+func expectMessages(t *testing.T, got []string, expected ...string) {
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("received %q rather than %q", got, expected)
+	}
+}
+
+func newTestFanOut(t *testing.T, home HomeConfig) (fo *FanOut) {
+	fo, err := NewFanOut(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fo
+}
+
+// The tests below queue messages using deliver, rather than Run, so that it is
+// known which messages are queued when the queue policy is applied
+
+func TestFanOutCoalesce(t *testing.T) {
+	fo := newTestFanOut(t, HomeConfig{})
+	quitC := make(chan struct{})
+	defer close(quitC)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub := fo.Subscribe(ctx, "coalesce", Filter{}, Queue{Size: 3, Policy: CoalesceLatest})
+
+	fo.deliver(statusMessage("a", 1), quitC)
+	waitInFlight(t, sub)
+
+	// Statuses, and health, are only replaced by a message with the same topic and url
+	fo.deliver(statusMessage("a", 2), quitC)
+	fo.deliver(statusMessage("b", 1), quitC)
+	fo.deliver(healthMessage("a", model.HealthOnline), quitC)
+	fo.deliver(statusMessage("a", 3), quitC)
+
+	if stats := sub.Stats(); stats.Queued != 3 || stats.Coalesced != 1 || stats.Dropped != 0 {
+		t.Fatalf("the statuses were queued as %+v", stats)
+	}
+
+	// Events are never coalesced, with the queue full the oldest message is dropped
+	fo.deliver(eventMessage("a"), quitC)
+	fo.deliver(healthMessage("a", model.HealthStale), quitC)
+
+	if stats := sub.Stats(); stats.Queued != 3 || stats.Coalesced != 2 || stats.Dropped != 1 {
+		t.Fatalf("the event was queued as %+v", stats)
+	}
+
+	expectMessages(t, receive(t, sub, 4), "status a 1", "status b 1", "health a stale", "events a")
+	waitStats(t, sub, func(stats SubscriberStats) bool { return stats.Delivered == 4 })
+
+	for name, expected := range map[string]string{"coalesce.delivered": "4", "coalesce.dropped": "1", "coalesce.coalesced": "2"} {
+		if count := fo.stats.Get(name); count == nil || count.String() != expected {
+			t.Fatalf("%s was %v rather than %s", name, count, expected)
+		}
+	}
+}
+
+func TestFanOutDropOldest(t *testing.T) {
+	fo := newTestFanOut(t, HomeConfig{})
+	quitC := make(chan struct{})
+	defer close(quitC)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub := fo.Subscribe(ctx, "drop", Filter{Topics: []Topic{TopicStatus}}, Queue{Size: 2, Policy: DropOldest})
+
+	fo.deliver(statusMessage("a", 1), quitC)
+	waitInFlight(t, sub)
+	for seq := uint64(2); seq <= 5; seq++ {
+		fo.deliver(statusMessage("a", seq), quitC)
+	}
+	// Filtered messages are neither queued nor counted as dropped
+	fo.deliver(eventMessage("a"), quitC)
+
+	if stats := sub.Stats(); stats.Queued != 2 || stats.Dropped != 2 || stats.Coalesced != 0 {
+		t.Fatalf("the statuses were queued as %+v", stats)
+	}
+	expectMessages(t, receive(t, sub, 3), "status a 1", "status a 4", "status a 5")
+}
+
+func TestFanOutBlock(t *testing.T) {
+	fo := newTestFanOut(t, HomeConfig{})
+	quitC := make(chan struct{})
+	defer close(quitC)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub := fo.Subscribe(ctx, "block", Filter{}, Queue{Size: 1, Policy: Block})
+	other := fo.Subscribe(ctx, "other", Filter{}, Queue{Size: 10, Policy: DropOldest})
+
+	fo.deliver(statusMessage("a", 1), quitC)
+	waitInFlight(t, sub)
+	fo.deliver(statusMessage("a", 2), quitC)
+
+	// With the queue full the fan-out waits for the subscriber rather than dropping
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		fo.deliver(statusMessage("a", 3), quitC)
+		fo.deliver(statusMessage("a", 4), quitC)
+	}()
+
+	select {
+	case <-doneC:
+		t.Fatal("the fan-out did not wait for the blocking subscriber")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	expectMessages(t, receive(t, sub, 4), "status a 1", "status a 2", "status a 3", "status a 4")
+	select {
+	case <-doneC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fan-out remained blocked once the subscriber had caught up")
+	}
+
+	if stats := sub.Stats(); stats.Dropped != 0 || stats.Coalesced != 0 {
+		t.Fatalf("the blocking subscriber lost messages, %+v", stats)
+	}
+	expectMessages(t, receive(t, other, 4), "status a 1", "status a 2", "status a 3", "status a 4")
+}
+
+func TestFanOutUnsubscribe(t *testing.T) {
+	fo := newTestFanOut(t, HomeConfig{})
+	quitC := make(chan struct{})
+	defer close(quitC)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := fo.Subscribe(ctx, "leaving", Filter{}, Queue{Size: 1, Policy: Block})
+
+	keep, cancelKeep := context.WithCancel(context.Background())
+	defer cancelKeep()
+	fo.Subscribe(keep, "staying", Filter{}, Queue{Size: 10})
+
+	fo.deliver(statusMessage("a", 1), quitC)
+	waitInFlight(t, sub)
+	fo.deliver(statusMessage("a", 2), quitC)
+
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		fo.deliver(statusMessage("a", 3), quitC)
+	}()
+
+	select {
+	case <-doneC:
+		t.Fatal("the fan-out did not wait for the blocking subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Ending the subscription releases a fan-out blocked on it and closes its channel
+	cancel()
+	select {
+	case <-doneC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fan-out remained blocked on a subscriber that had gone")
+	}
+
+	deadline := time.After(5 * time.Second)
+	for isOpen := true; isOpen; {
+		select {
+		case _, isOpen = <-sub.C:
+		case <-deadline:
+			t.Fatal("the channel of the subscription was not closed")
+		}
+	}
+
+	stats := fo.Stats()
+	if len(stats) != 1 || stats[0].Name != "staying" {
+		t.Fatalf("the subscribers were %+v after one unsubscribed", stats)
+	}
+}
@@ -6,23 +6,91 @@ package mawt
 
 import (
 	"github.com/TeamNorCal/mawt/model"
+
 	"github.com/karlmutch/errors"
 )
 
+// Gateway connects the tecthulhus to the LEDs and sound effects using its own
+// fan-out, see fanout.go, allowing several gateways to run within one process
+//
 type Gateway struct {
+	fanout  *FanOut
+	leds    *FadeCandy
+	sfx     *SFXState
+	portals *portalCache
 }
 
-func (*Gateway) Start(server string, debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) (tectC chan *model.PortalMsg, subscribeC chan chan *model.PortalMsg) {
+// Start begins delivering portal messages to the LEDs and sound effects, the
+// returned fan-out is used to publish the messages from the tecthulhus and can
+// be subscribed to by other components
+//
+func (gw *Gateway) Start(leds LEDConfig, home HomeConfig, audio AudioConfig, errorC chan<- errors.Error, quitC <-chan struct{}) (fanout *FanOut, err errors.Error) {
+
+	if gw.fanout, err = NewFanOut(home); err != nil {
+		return nil, err
+	}
+	go gw.fanout.Run(quitC)
 
-	tectC, subscribeC = startFanOut(quitC)
+	gw.portals = newPortalCache(gw.fanout, home, quitC)
 
 	// After creating the broadcast channel we add a listener
 	// for the sounds effects so that it can process detected
 	// state changes etc
 	//
-	go StartSFX(subscribeC, errorC, quitC)
+	gw.sfx = StartSFX(audio, gw.fanout, errorC, quitC)
+
+	if gw.leds, err = StartFadeCandy(leds, gw.fanout, errorC, quitC); err != nil {
+		return nil, err
+	}
+
+	return gw.fanout, nil
+}
+
+// FanOut returns the fan-out used to deliver the portal messages
+//
+func (gw *Gateway) FanOut() (fanout *FanOut) {
+	return gw.fanout
+}
+
+// LEDs returns the fadecandy driver used for the LEDs
+//
+func (gw *Gateway) LEDs() (fc *FadeCandy) {
+	return gw.leds
+}
 
-	StartFadeCandy(server, subscribeC, debug, errorC, quitC)
+// Audio returns the audio output used for the sound effects
+//
+func (gw *Gateway) Audio() (player *AudioPlayer) {
+	return gw.sfx.Audio()
+}
+
+// Portals returns what is known about each of the tecthulhus
+//
+func (gw *Gateway) Portals() (portals []PortalState) {
+	return gw.portals.snapshot()
+}
+
+// InjectStatus publishes a status for a tecthulhu as though the tecthulhu had reported
+// it, an empty url is taken to be the home portal
+//
+func (gw *Gateway) InjectStatus(url string, status *model.Status) (err errors.Error) {
+	return gw.portals.inject(url, status)
+}
+
+// Home returns the current home portal and the policy used to select it
+//
+func (gw *Gateway) Home() (url string, policy HomePolicy) {
+	return gw.fanout.Home()
+}
+
+// SetHome makes a tecthulhu the home portal, switching to the fixed policy
+//
+func (gw *Gateway) SetHome(url string) (err errors.Error) {
+	return gw.fanout.SetHomePolicy(HomeFixed, url)
+}
 
-	return tectC, subscribeC
+// SetHomePolicy changes how the home portal is selected
+//
+func (gw *Gateway) SetHomePolicy(policy HomePolicy) (err errors.Error) {
+	return gw.fanout.SetHomePolicy(policy, "")
 }
@@ -0,0 +1,104 @@
+package mawt
+
+// This module implements the state machine used to track the liveness of
+// each tecthulhu.  Devices start off connecting, move to online when a
+// status is received, become stale when status checks begin failing, and
+// are declared offline once no status has been received for a period of time.
+
+import (
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/karlmutch/errors"
+)
+
+type portalHealth struct {
+	url          string
+	offlineAfter time.Duration
+
+	state    model.HealthState
+	started  time.Time
+	since    time.Time
+	lastSeen time.Time
+	failures int
+}
+
+func newPortalHealth(url string, offlineAfter time.Duration, now time.Time) (health *portalHealth) {
+	return &portalHealth{
+		url:          url,
+		offlineAfter: offlineAfter,
+		state:        model.HealthConnecting,
+		started:      now,
+		since:        now,
+	}
+}
+
+// update applies the result of a status check and returns a message describing
+// the new state if the check caused a transition, otherwise nil is returned
+//
+func (health *portalHealth) update(now time.Time, err errors.Error) (msg *model.HealthMsg) {
+
+	next := health.state
+
+	if err == nil {
+		health.failures = 0
+		health.lastSeen = now
+		next = model.HealthOnline
+	} else {
+		health.failures++
+
+		// Time without a good status is measured from the last good status, or
+		// from when we started if the device has never answered
+		reference := health.lastSeen
+		if reference.IsZero() {
+			reference = health.started
+		}
+		silent := now.Sub(reference) >= health.offlineAfter
+
+		switch health.state {
+		case model.HealthOnline:
+			next = model.HealthStale
+			if silent {
+				next = model.HealthOffline
+			}
+		case model.HealthConnecting, model.HealthStale:
+			if silent {
+				next = model.HealthOffline
+			}
+		}
+	}
+
+	if next == health.state {
+		return nil
+	}
+
+	msg = &model.HealthMsg{
+		URL:      health.url,
+		State:    next,
+		Previous: health.state,
+		Since:    now,
+		LastSeen: health.lastSeen,
+		Failures: health.failures,
+	}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+
+	health.state = next
+	health.since = now
+
+	return msg
+}
+
+// current returns a message describing the present state
+//
+func (health *portalHealth) current() (msg *model.HealthMsg) {
+	return &model.HealthMsg{
+		URL:      health.url,
+		State:    health.state,
+		Previous: health.state,
+		Since:    health.since,
+		LastSeen: health.lastSeen,
+		Failures: health.failures,
+	}
+}
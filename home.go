@@ -0,0 +1,219 @@
+package mawt
+
+// This module decides which of the tecthulhus is the home portal, the one
+// whose state drives the LEDs and sound effects.  The fan-out, see fanout.go,
+// passes every message through the selector and marks those for the home
+// portal before they are delivered.
+//
+// When the home portal changes the selector has the fan-out announce the
+// change on the home topic, and then deliver the last known status and health
+// of the new home portal, so that subscribers switch over without waiting for
+// the next check of the device.
+
+import (
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// HomePolicy selects the portal that drives the installation
+//
+type HomePolicy string
+
+const (
+	// HomeFixed uses a single portal, by default the first tecthulhu
+	HomeFixed HomePolicy = "fixed"
+
+	// HomeFirstHealthy uses the first tecthulhu, in the order they were supplied, that
+	// is online
+	HomeFirstHealthy HomePolicy = "first-healthy"
+
+	// HomeMostRecent uses the online tecthulhu whose portal has changed most recently
+	HomeMostRecent HomePolicy = "most-recently-changed"
+)
+
+// HomeConfig contains the settings used to select the home portal
+//
+type HomeConfig struct {
+	Policy HomePolicy
+	URLs   []string // The tecthulhus in order of preference
+	Fixed  string   // The home portal for the fixed policy, the first URL when empty
+}
+
+// HomeChange is delivered on the home topic when the home portal changes
+//
+type HomeChange struct {
+	URL      string     `json:"url"`
+	Previous string     `json:"previous"`
+	Policy   HomePolicy `json:"policy"`
+}
+
+func validHomePolicy(policy HomePolicy) (isValid bool) {
+	switch policy {
+	case HomeFixed, HomeFirstHealthy, HomeMostRecent:
+		return true
+	}
+	return false
+}
+
+// homePortal is what the selector knows about a single tecthulhu
+//
+type homePortal struct {
+	health  model.HealthState
+	seq     uint64
+	changed time.Time // When the portal was last seen to change, zero if never
+
+	status    *model.PortalMsg // The last status published for the portal
+	healthMsg *model.HealthMsg // The last health published for the portal
+}
+
+// homeSelector tracks the tecthulhus and chooses the home portal, it is used only
+// from within the fan-out goroutine
+//
+type homeSelector struct {
+	policy  HomePolicy
+	urls    []string
+	fixed   string
+	current string
+	portals map[string]*homePortal
+}
+
+func newHomeSelector(cfg HomeConfig) (selector *homeSelector, err errors.Error) {
+	if len(cfg.Policy) == 0 {
+		cfg.Policy = HomeFixed
+	}
+	if !validHomePolicy(cfg.Policy) {
+		return nil, errors.New("unknown home portal policy").With("policy", cfg.Policy).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	selector = &homeSelector{
+		policy:  cfg.Policy,
+		urls:    []string{},
+		portals: map[string]*homePortal{},
+	}
+	for _, url := range cfg.URLs {
+		selector.portal(url)
+	}
+
+	selector.fixed = cfg.Fixed
+	if len(selector.fixed) == 0 && len(selector.urls) != 0 {
+		selector.fixed = selector.urls[0]
+	}
+	if len(selector.fixed) != 0 {
+		if _, isPresent := selector.portals[selector.fixed]; !isPresent {
+			return nil, errors.New("the home portal is not one of the tecthulhus").With("url", selector.fixed).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	// Until something is known about the tecthulhus the fixed home is used
+	selector.current = selector.fixed
+	return selector, nil
+}
+
+// portal returns the record for a tecthulhu, those not supplied in the configuration
+// are added, in the order they are seen, as they publish messages
+//
+func (selector *homeSelector) portal(url string) (portal *homePortal) {
+	if portal, isPresent := selector.portals[url]; isPresent {
+		return portal
+	}
+	portal = &homePortal{
+		health: model.HealthConnecting,
+	}
+	selector.portals[url] = portal
+	selector.urls = append(selector.urls, url)
+	return portal
+}
+
+// observe records what a message says about its tecthulhu
+//
+func (selector *homeSelector) observe(msg *Message, now time.Time) {
+	if len(msg.URL) == 0 {
+		return
+	}
+	portal := selector.portal(msg.URL)
+
+	switch msg.Topic {
+	case TopicStatus:
+		// Injected statuses, see portals.go, were not reported by the tecthulhu and
+		// so neither count as a change nor move the home portal
+		if msg.Status.Injected {
+			return
+		}
+		// Status sequence numbers change whenever the portal does, see tecthulhu.go
+		if portal.status != nil && msg.Status.Seq != portal.seq {
+			portal.changed = now
+		}
+		portal.seq = msg.Status.Seq
+		portal.status = msg.Status
+	case TopicHealth:
+		portal.health = msg.Health.State
+		portal.healthMsg = msg.Health
+	}
+}
+
+// choose applies the policy and returns the home portal
+//
+func (selector *homeSelector) choose() (url string) {
+	online := func(url string) bool {
+		return selector.portals[url].health == model.HealthOnline
+	}
+
+	switch selector.policy {
+	case HomeFirstHealthy:
+		for _, url := range selector.urls {
+			if online(url) {
+				return url
+			}
+		}
+	case HomeMostRecent:
+		url = ""
+		for _, candidate := range selector.urls {
+			portal := selector.portals[candidate]
+			if !online(candidate) || portal.changed.IsZero() {
+				continue
+			}
+			if len(url) == 0 || portal.changed.After(selector.portals[url].changed) {
+				url = candidate
+			}
+		}
+		if len(url) != 0 {
+			return url
+		}
+		// When no online portal has changed the current home is kept while it
+		// remains online, otherwise the first online portal is used
+		if len(selector.current) != 0 && online(selector.current) {
+			return selector.current
+		}
+		for _, url := range selector.urls {
+			if online(url) {
+				return url
+			}
+		}
+	default:
+		return selector.fixed
+	}
+
+	// With nothing online there is no reason to move away from the current home
+	return selector.current
+}
+
+// setPolicy changes the policy, a non empty url also changes the home portal used by
+// the fixed policy
+//
+func (selector *homeSelector) setPolicy(policy HomePolicy, url string) (err errors.Error) {
+	if !validHomePolicy(policy) {
+		return errors.New("unknown home portal policy").With("policy", policy).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(url) != 0 {
+		if _, isPresent := selector.portals[url]; !isPresent {
+			return errors.New("the home portal is not one of the tecthulhus").With("url", url).With("stack", stack.Trace().TrimRuntime())
+		}
+		selector.fixed = url
+	}
+	selector.policy = policy
+	return nil
+}
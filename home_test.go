@@ -0,0 +1,167 @@
+package mawt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+)
+
+// homeStep is a message seen by the home selector followed by the home portal
+// expected once it has been observed
+//
+type homeStep struct {
+	msg  *Message
+	home string
+}
+
+// runHomeSteps passes the messages to the selector, a second apart, checking the
+// home portal chosen after each as the fan-out would
+//
+func runHomeSteps(t *testing.T, selector *homeSelector, steps []homeStep) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, step := range steps {
+		now = now.Add(time.Second)
+		selector.observe(step.msg, now)
+		selector.current = selector.choose()
+
+		if selector.current != step.home {
+			t.Fatalf("step %d, %s, chose %s rather than %s", i, describe(step.msg), selector.current, step.home)
+		}
+	}
+}
+
+func newTestSelector(t *testing.T, cfg HomeConfig) (selector *homeSelector) {
+	selector, err := newHomeSelector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return selector
+}
+
+func TestHomeFixed(t *testing.T) {
+	urls := []string{"a", "b", "c"}
+
+	if _, err := newHomeSelector(HomeConfig{URLs: urls, Fixed: "d"}); err == nil {
+		t.Fatal("a fixed home that is not one of the tecthulhus was accepted")
+	}
+	if _, err := newHomeSelector(HomeConfig{Policy: "loudest", URLs: urls}); err == nil {
+		t.Fatal("an unknown policy was accepted")
+	}
+
+	selector := newTestSelector(t, HomeConfig{URLs: urls})
+	if selector.policy != HomeFixed || selector.current != "a" {
+		t.Fatalf("the default was the %s policy using %s", selector.policy, selector.current)
+	}
+
+	runHomeSteps(t, selector, []homeStep{
+		{healthMessage("b", model.HealthOnline), "a"},
+		{statusMessage("b", 1), "a"},
+		{statusMessage("b", 2), "a"},
+		{healthMessage("a", model.HealthOffline), "a"},
+	})
+
+	if err := selector.setPolicy(HomeFixed, "d"); err == nil {
+		t.Fatal("a fixed home that is not one of the tecthulhus was accepted")
+	}
+	if err := selector.setPolicy(HomeFixed, "c"); err != nil {
+		t.Fatal(err)
+	}
+	runHomeSteps(t, selector, []homeStep{
+		{healthMessage("c", model.HealthOffline), "c"},
+	})
+}
+
+func TestHomeFirstHealthy(t *testing.T) {
+	selector := newTestSelector(t, HomeConfig{Policy: HomeFirstHealthy, URLs: []string{"a", "b", "c"}})
+
+	runHomeSteps(t, selector, []homeStep{
+		{statusMessage("a", 1), "a"},
+		{healthMessage("c", model.HealthOnline), "c"},
+		{healthMessage("b", model.HealthOnline), "b"},
+		{healthMessage("a", model.HealthOnline), "a"},
+		{healthMessage("a", model.HealthStale), "b"},
+		{healthMessage("b", model.HealthOffline), "c"},
+		// With nothing online the last home is kept
+		{healthMessage("c", model.HealthOffline), "c"},
+		// Tecthulhus that were not configured are preferred after those that were
+		{healthMessage("d", model.HealthOnline), "d"},
+		{healthMessage("c", model.HealthOnline), "c"},
+	})
+}
+
+func TestHomeMostRecent(t *testing.T) {
+	selector := newTestSelector(t, HomeConfig{Policy: HomeMostRecent, URLs: []string{"a", "b", "c"}})
+
+	injected := statusMessage("a", 9)
+	injected.Status.Injected = true
+
+	runHomeSteps(t, selector, []homeStep{
+		{healthMessage("a", model.HealthOnline), "a"},
+		{healthMessage("b", model.HealthOnline), "a"},
+		{healthMessage("c", model.HealthOnline), "a"},
+		// The first status from a tecthulhu is not a change
+		{statusMessage("a", 1), "a"},
+		{statusMessage("b", 1), "a"},
+		{statusMessage("c", 1), "a"},
+		{statusMessage("b", 2), "b"},
+		{statusMessage("c", 2), "c"},
+		// A status that repeats the last, or was injected, is not a change
+		{statusMessage("b", 2), "c"},
+		{injected, "c"},
+		{statusMessage("a", 2), "a"},
+		{healthMessage("a", model.HealthOffline), "c"},
+		{healthMessage("c", model.HealthOffline), "b"},
+		{healthMessage("b", model.HealthOffline), "b"},
+	})
+}
+
+// TestHomeChange checks that the fan-out announces a new home portal and then
+// repeats what is known about it to the subscribers
+//
+func TestHomeChange(t *testing.T) {
+	fo := newTestFanOut(t, HomeConfig{Policy: HomeFirstHealthy, URLs: []string{"a", "b"}})
+	quitC := make(chan struct{})
+	defer close(quitC)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub := fo.Subscribe(ctx, "home", Filter{HomeOnly: true}, Queue{Size: 10, Policy: Block})
+
+	go fo.Run(quitC)
+
+	if err := fo.PublishStatus(&model.PortalMsg{URL: "b", Seq: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fo.PublishHealth(&model.HealthMsg{URL: "b", State: model.HealthOnline}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, receive(t, sub, 3), "home b<a", "health b online", "status b 1")
+
+	if url, policy := fo.Home(); url != "b" || policy != HomeFirstHealthy {
+		t.Fatalf("the home was %s using the %s policy", url, policy)
+	}
+
+	// Messages for other tecthulhus are not delivered to home only subscribers
+	if err := fo.PublishStatus(&model.PortalMsg{URL: "a", Seq: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fo.PublishStatus(&model.PortalMsg{URL: "b", Seq: 2}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, receive(t, sub, 1), "status b 2")
+
+	if err := fo.SetHomePolicy(HomeFixed, "a"); err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, receive(t, sub, 2), "home a<b", "status a 1")
+
+	if url, policy := fo.Home(); url != "a" || policy != HomeFixed {
+		t.Fatalf("the home was %s using the %s policy", url, policy)
+	}
+	if err := fo.SetHomePolicy("loudest", ""); err == nil {
+		t.Fatal("an unknown policy was accepted")
+	}
+}
@@ -0,0 +1,472 @@
+package mawt
+
+// This module loads the physical layout of the LEDs, describing the controller
+// boards, the strands attached to them, and which pixels make up each of the
+// universes drawn by the animation.  The layout is checked against the frames
+// produced by the animation before any frames are sent.
+//
+// Two file formats are understood.  The first is the fcserver configuration
+// file, see fc_configs/, with the devices[].map entries each routing an OPC
+// channel, which is one universe, onto a range of output pixels.  Fadecandy
+// boards have 8 outputs of up to 64 pixels.  Universes are named using the
+// animation universe with an index one less than the OPC channel.
+//
+// The second is the mawt format that names the universes and sets the OPC
+// channel for each strand, for example
+//
+//	{
+//	    "boards": [
+//	        {"serial": "AMWPGCSIYCRCKYHL", "strands": [{"channel": 1, "pixels": 60}, ...]}
+//	    ],
+//	    "universes": [
+//	        {"name": "base1", "ranges": [{"board": 0, "strand": 0, "startPixel": 0, "size": 30}]},
+//	        ...
+//	    ]
+//	}
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/TeamNorCal/animation"
+	animationModel "github.com/TeamNorCal/animation/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	fadecandyOutputs      = 8
+	fadecandyOutputPixels = 64
+)
+
+// LayoutStrand is a single string of LEDs attached to a controller output
+type LayoutStrand struct {
+	Channel animationModel.OpcChannel `json:"channel"` // The OPC channel used when sending the whole strand
+	Pixels  int                       `json:"pixels"`
+}
+
+// LayoutBoard is a controller board, such as a fadecandy
+type LayoutBoard struct {
+	Serial  string         `json:"serial"`
+	Strands []LayoutStrand `json:"strands"`
+}
+
+// LayoutUniverse is a logical group of pixels drawn by the animation, the
+// pixels are taken from the ranges in order
+type LayoutUniverse struct {
+	Name    string                    `json:"name"`
+	Channel animationModel.OpcChannel `json:"channel"` // The channel of the universe in the animation frames
+	Ranges  []animation.PhysicalRange `json:"ranges"`
+}
+
+// Layout is the physical arrangement of the LEDs
+type Layout struct {
+	Boards    []LayoutBoard    `json:"boards"`
+	Universes []LayoutUniverse `json:"universes"`
+}
+
+// fcserverConfig contains the parts of the fcserver configuration that describe the layout
+type fcserverConfig struct {
+	Devices []struct {
+		Type   string              `json:"type"`
+		Serial string              `json:"serial"`
+		Map    [][]json.RawMessage `json:"map"`
+	} `json:"devices"`
+}
+
+// LoadLayout reads a layout file in either the fcserver, or mawt, format
+//
+func LoadLayout(fn string) (layout *Layout, err errors.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if layout, err = parseLayout(data); err != nil {
+		return nil, err.With("file", fn)
+	}
+	return layout, nil
+}
+
+func parseLayout(data []byte) (layout *Layout, err errors.Error) {
+	sniff := map[string]json.RawMessage{}
+	if errGo := json.Unmarshal(data, &sniff); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	switch {
+	case sniff["devices"] != nil:
+		layout, err = parseFCServerLayout(data)
+	case sniff["universes"] != nil:
+		layout = &Layout{}
+		if errGo := json.Unmarshal(data, layout); errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		err = layout.nameChannels()
+	default:
+		return nil, errors.New("layout has neither fcserver devices nor mawt universes").With("stack", stack.Trace().TrimRuntime())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = layout.check(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// universeForIndex returns the name of the animation universe that occupies the
+// index within the animation frames
+//
+func universeForIndex(index int) (name string, isPresent bool) {
+	for name, universe := range animation.Universes {
+		if universe.Index == index {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// parseFCServerLayout converts the map of an fcserver configuration.  Each map entry is
+// [ OPC Channel, First OPC Pixel, First output Pixel, Pixel count ] with an optional
+// color order that is not used by mawt.  The strands of each board are sized to the
+// highest pixel mapped on them and are given OPC channels numbered, from 1, across
+// the outputs of all of the boards.
+//
+func parseFCServerLayout(data []byte) (layout *Layout, err errors.Error) {
+	cfg := &fcserverConfig{}
+	if errGo := json.Unmarshal(data, cfg); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	layout = &Layout{
+		Boards:    []LayoutBoard{},
+		Universes: []LayoutUniverse{},
+	}
+	universes := map[animationModel.OpcChannel]*LayoutUniverse{}
+
+	for board, device := range cfg.Devices {
+		if device.Type != "fadecandy" {
+			errGo := fmt.Errorf("only fadecandy devices are supported")
+			return nil, errors.Wrap(errGo).With("type", device.Type).With("serial", device.Serial).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		strands := make([]LayoutStrand, fadecandyOutputs)
+		for strand := range strands {
+			strands[strand].Channel = animationModel.OpcChannel(board*fadecandyOutputs + strand + 1)
+		}
+
+		for _, entry := range device.Map {
+			values := [4]int{}
+			if len(entry) < len(values) {
+				errGo := fmt.Errorf("fcserver map entries need an OPC channel, first OPC pixel, first output pixel, and pixel count")
+				return nil, errors.Wrap(errGo).With("serial", device.Serial).With("stack", stack.Trace().TrimRuntime())
+			}
+			for i := range values {
+				if errGo := json.Unmarshal(entry[i], &values[i]); errGo != nil {
+					return nil, errors.Wrap(errGo).With("serial", device.Serial).With("stack", stack.Trace().TrimRuntime())
+				}
+			}
+			channel, opcPixel, outputPixel, count := animationModel.OpcChannel(values[0]), values[1], values[2], values[3]
+
+			strand := outputPixel / fadecandyOutputPixels
+			start := outputPixel % fadecandyOutputPixels
+			if count < 1 || strand >= fadecandyOutputs || start+count > fadecandyOutputPixels {
+				errGo := fmt.Errorf("fcserver map entry does not fit within a single fadecandy output")
+				return nil, errors.Wrap(errGo).With("serial", device.Serial).With("channel", channel).With("stack", stack.Trace().TrimRuntime())
+			}
+			if start+count > strands[strand].Pixels {
+				strands[strand].Pixels = start + count
+			}
+
+			universe, isPresent := universes[channel]
+			if !isPresent {
+				name, isKnown := universeForIndex(int(channel) - 1)
+				if !isKnown {
+					errGo := fmt.Errorf("fcserver map uses an OPC channel that the animation does not draw")
+					return nil, errors.Wrap(errGo).With("serial", device.Serial).With("channel", channel).With("stack", stack.Trace().TrimRuntime())
+				}
+				universe = &LayoutUniverse{
+					Name:    name,
+					Channel: channel,
+				}
+				universes[channel] = universe
+			}
+
+			// Entries for a channel are expected to cover its pixels in order
+			size := 0
+			for _, r := range universe.Ranges {
+				size += int(r.Size)
+			}
+			if opcPixel != size {
+				errGo := fmt.Errorf("fcserver map entries for an OPC channel must be contiguous and in order")
+				return nil, errors.Wrap(errGo).With("serial", device.Serial).With("channel", channel).With("stack", stack.Trace().TrimRuntime())
+			}
+
+			universe.Ranges = append(universe.Ranges, animation.PhysicalRange{
+				Board:      uint(board),
+				Strand:     uint(strand),
+				StartPixel: uint(start),
+				Size:       uint(count),
+			})
+		}
+
+		layout.Boards = append(layout.Boards, LayoutBoard{
+			Serial:  device.Serial,
+			Strands: strands,
+		})
+	}
+
+	for _, universe := range universes {
+		layout.Universes = append(layout.Universes, *universe)
+	}
+	sort.Slice(layout.Universes, func(i, j int) bool {
+		return layout.Universes[i].Channel < layout.Universes[j].Channel
+	})
+
+	return layout, nil
+}
+
+// nameChannels assigns the animation frame channel to universes that were
+// loaded using their names
+//
+func (layout *Layout) nameChannels() (err errors.Error) {
+	for i, universe := range layout.Universes {
+		known, isPresent := animation.Universes[universe.Name]
+		if !isPresent {
+			errGo := fmt.Errorf("layout universe is not drawn by the animation")
+			return errors.Wrap(errGo).With("universe", universe.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		layout.Universes[i].Channel = animationModel.OpcChannel(known.Index + 1)
+	}
+	return nil
+}
+
+// check validates that the universes lie within the strands and that no pixel
+// is used by more than one universe
+//
+func (layout *Layout) check() (err errors.Error) {
+
+	if len(layout.Universes) == 0 {
+		return errors.New("layout has no universes").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	channels := map[animationModel.OpcChannel]int{}
+	for board, b := range layout.Boards {
+		for strand, s := range b.Strands {
+			if s.Pixels < 0 {
+				return errors.New("layout strand has a negative pixel count").With("board", board).With("strand", strand).With("stack", stack.Trace().TrimRuntime())
+			}
+			if s.Pixels == 0 {
+				continue
+			}
+			if s.Channel < 1 || s.Channel > 255 {
+				return errors.New("layout strand OPC channel must be between 1 and 255").With("board", board).With("strand", strand).With("stack", stack.Trace().TrimRuntime())
+			}
+			if channels[s.Channel]++; channels[s.Channel] > 1 {
+				return errors.New("layout strands share an OPC channel").With("channel", s.Channel).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+	}
+
+	names := map[string]bool{}
+	used := map[[3]uint]string{}
+
+	for _, universe := range layout.Universes {
+		if names[universe.Name] {
+			return errors.New("layout universe appears more than once").With("universe", universe.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		names[universe.Name] = true
+
+		for _, r := range universe.Ranges {
+			if int(r.Board) >= len(layout.Boards) || int(r.Strand) >= len(layout.Boards[r.Board].Strands) {
+				return errors.New("layout universe uses a strand that does not exist").With("universe", universe.Name).
+					With("board", r.Board).With("strand", r.Strand).With("stack", stack.Trace().TrimRuntime())
+			}
+			if int(r.StartPixel+r.Size) > layout.Boards[r.Board].Strands[r.Strand].Pixels {
+				return errors.New("layout universe extends past the end of its strand").With("universe", universe.Name).
+					With("board", r.Board).With("strand", r.Strand).With("stack", stack.Trace().TrimRuntime())
+			}
+			for pixel := r.StartPixel; pixel < r.StartPixel+r.Size; pixel++ {
+				location := [3]uint{r.Board, r.Strand, pixel}
+				if other, isPresent := used[location]; isPresent {
+					return errors.New("layout universes share a pixel").With("universe", universe.Name).With("other", other).
+						With("board", r.Board).With("strand", r.Strand).With("pixel", pixel).With("stack", stack.Trace().TrimRuntime())
+				}
+				used[location] = universe.Name
+			}
+		}
+	}
+	return nil
+}
+
+// size returns the number of pixels in the universe
+//
+func (universe *LayoutUniverse) size() (pixels int) {
+	for _, r := range universe.Ranges {
+		pixels += int(r.Size)
+	}
+	return pixels
+}
+
+// Dimensions returns the number of pixels on each strand of each board, in the form
+// used to create an animation.Mapping
+//
+func (layout *Layout) Dimensions() (dimensions [][]int) {
+	dimensions = make([][]int, len(layout.Boards))
+	for board, b := range layout.Boards {
+		dimensions[board] = make([]int, len(b.Strands))
+		for strand, s := range b.Strands {
+			dimensions[board][strand] = s.Pixels
+		}
+	}
+	return dimensions
+}
+
+// Validate checks that the frames produced by the animation match the layout, each
+// channel in the frame must have a universe of the same size and each universe
+// must be drawn by the animation
+//
+func (layout *Layout) Validate(frame []animationModel.ChannelData) (err errors.Error) {
+	universes := map[animationModel.OpcChannel]*LayoutUniverse{}
+	for i, universe := range layout.Universes {
+		universes[universe.Channel] = &layout.Universes[i]
+	}
+
+	drawn := map[animationModel.OpcChannel]bool{}
+	for _, channel := range frame {
+		drawn[channel.ChannelNum] = true
+
+		universe, isPresent := universes[channel.ChannelNum]
+		if !isPresent {
+			return errors.New("animation draws a channel that is not in the layout").With("channel", channel.ChannelNum).With("stack", stack.Trace().TrimRuntime())
+		}
+		if universe.size() != len(channel.Data) {
+			return errors.New("animation and layout disagree on the size of a universe").With("universe", universe.Name).
+				With("animation", len(channel.Data)).With("layout", universe.size()).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	for _, universe := range layout.Universes {
+		if !drawn[universe.Channel] {
+			return errors.New("layout universe is not drawn by the animation").With("universe", universe.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
+
+// DefaultLayout returns a layout with each animation universe on a strand of its
+// own, using the OPC channel of the universe, with strands filling the outputs of
+// as many fadecandy boards as are needed.  This matches the fcserver configuration
+// used when no layout is supplied.
+//
+func DefaultLayout() (layout *Layout) {
+	layout = &Layout{
+		Boards:    []LayoutBoard{},
+		Universes: []LayoutUniverse{},
+	}
+
+	names := make([]string, 0, len(animation.Universes))
+	for name := range animation.Universes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return animation.Universes[names[i]].Index < animation.Universes[names[j]].Index
+	})
+
+	for i, name := range names {
+		board, strand := i/fadecandyOutputs, i%fadecandyOutputs
+		if strand == 0 {
+			layout.Boards = append(layout.Boards, LayoutBoard{
+				Strands: []LayoutStrand{},
+			})
+		}
+
+		universe := animation.Universes[name]
+		channel := animationModel.OpcChannel(universe.Index + 1)
+
+		layout.Boards[board].Strands = append(layout.Boards[board].Strands, LayoutStrand{
+			Channel: channel,
+			Pixels:  universe.Size,
+		})
+		layout.Universes = append(layout.Universes, LayoutUniverse{
+			Name:    name,
+			Channel: channel,
+			Ranges: []animation.PhysicalRange{{
+				Board:      uint(board),
+				Strand:     uint(strand),
+				StartPixel: 0,
+				Size:       uint(universe.Size),
+			}},
+		})
+	}
+	return layout
+}
+
+// strandMapper copies the universes drawn by the animation onto the physical strands
+// described by a layout
+//
+type strandMapper struct {
+	layout  *Layout
+	mapping animation.Mapping
+	ids     map[animationModel.OpcChannel]uint // Mapping IDs indexed using the animation channel
+}
+
+func newStrandMapper(layout *Layout) (mapper *strandMapper, err errors.Error) {
+	mapper = &strandMapper{
+		layout:  layout,
+		mapping: animation.NewMapping(layout.Dimensions()),
+		ids:     map[animationModel.OpcChannel]uint{},
+	}
+
+	for _, universe := range layout.Universes {
+		if !mapper.mapping.AddUniverse(universe.Name, universe.Ranges) {
+			return nil, errors.New("layout universe could not be mapped").With("universe", universe.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		id, errGo := mapper.mapping.IDForUniverse(universe.Name)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("universe", universe.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		mapper.ids[universe.Channel] = id
+	}
+	return mapper, nil
+}
+
+// strands updates the physical strands from a frame and returns the data for each
+// strand labelled with the OPC channel of the strand.  The data references buffers
+// that are overwritten by the next frame.
+//
+func (mapper *strandMapper) strands(frame []animationModel.ChannelData) (strands []animationModel.ChannelData, err errors.Error) {
+
+	for _, channel := range frame {
+		id, isPresent := mapper.ids[channel.ChannelNum]
+		if !isPresent {
+			continue
+		}
+		if errGo := mapper.mapping.UpdateUniverse(id, channel.Data); errGo != nil {
+			return nil, errors.Wrap(errGo).With("channel", channel.ChannelNum).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	strands = make([]animationModel.ChannelData, 0, len(mapper.ids))
+	for board, b := range mapper.layout.Boards {
+		for strand, s := range b.Strands {
+			if s.Pixels == 0 {
+				continue
+			}
+			data, errGo := mapper.mapping.GetStrandData(uint(board), uint(strand))
+			if errGo != nil {
+				return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+			}
+			strands = append(strands, animationModel.ChannelData{
+				ChannelNum: s.Channel,
+				Data:       data,
+			})
+		}
+	}
+	return strands, nil
+}
@@ -0,0 +1,227 @@
+package mawt
+
+// This module implements a software mixer that combines a looping ambient
+// bed with any number of concurrently playing sound effects into a single
+// stream of 16 bit signed little endian interleaved stereo samples.
+//
+// The mixer is an io.Reader, the audio output pulls mixed samples from
+// it at the rate the hardware consumes them, and tests can simply read
+// the mix into a buffer.
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	mixerChannels = 2
+	mixerRate     = 44100
+
+	// Samples above this level are progressively compressed to prevent
+	// the sum of several sources from clipping harshly
+	mixerKnee = 0.75 * math.MaxInt16
+
+	// How long the ambient bed takes to duck, or recover, when effects
+	// start, or stop, playing
+	mixerDuckRamp = 0.05 // seconds
+)
+
+// mixerSource is a clip of interleaved stereo samples that is being played
+type mixerSource struct {
+	samples []int16
+	pos     int
+	loop    bool
+	gain    float32
+}
+
+// Mixer sums the ambient bed and effects into a single stream.  Gains are
+// linear with 1.0 leaving the source unchanged.  While any effect is playing
+// the ambient bed is ramped down to the Duck gain.
+//
+type Mixer struct {
+	ambient *mixerSource
+	effects []*mixerSource
+
+	AmbientGain float32
+	EffectGain  float32
+	Duck        float32
+
+	duckLevel float32
+	muted     bool // Sources continue to play but silence is produced
+
+	sync.Mutex
+}
+
+// NewMixer creates a mixer with no sources
+//
+func NewMixer(ambientGain float32, effectGain float32, duck float32) (mixer *Mixer) {
+	return &Mixer{
+		effects:     []*mixerSource{},
+		AmbientGain: ambientGain,
+		EffectGain:  effectGain,
+		Duck:        duck,
+		duckLevel:   1.0,
+	}
+}
+
+// SetAmbient replaces the looping ambient bed, a nil or empty clip silences
+// the bed
+//
+func (mixer *Mixer) SetAmbient(samples []int16) {
+	mixer.Lock()
+	defer mixer.Unlock()
+
+	if len(samples) == 0 {
+		mixer.ambient = nil
+		return
+	}
+	mixer.ambient = &mixerSource{
+		samples: samples,
+		loop:    true,
+		gain:    1.0,
+	}
+}
+
+// AddEffect starts an effect playing on top of anything already playing.  When
+// several clips are supplied they are played one after another.
+//
+func (mixer *Mixer) AddEffect(gain float32, clips ...[]int16) {
+	samples := []int16{}
+	for _, clip := range clips {
+		samples = append(samples, clip...)
+	}
+	if len(samples) == 0 {
+		return
+	}
+
+	mixer.Lock()
+	defer mixer.Unlock()
+
+	mixer.effects = append(mixer.effects, &mixerSource{
+		samples: samples,
+		gain:    gain,
+	})
+}
+
+// Playing returns the number of effects that are currently being mixed
+//
+func (mixer *Mixer) Playing() (count int) {
+	mixer.Lock()
+	defer mixer.Unlock()
+	return len(mixer.effects)
+}
+
+// SetMuted silences, or restores, the output of the mixer.  Sources continue to be
+// played while muted so that the ambient bed and effects resume from where they
+// would otherwise have been.
+//
+func (mixer *Mixer) SetMuted(muted bool) {
+	mixer.Lock()
+	defer mixer.Unlock()
+	mixer.muted = muted
+}
+
+// Muted returns true when the output of the mixer is being silenced
+//
+func (mixer *Mixer) Muted() (muted bool) {
+	mixer.Lock()
+	defer mixer.Unlock()
+	return mixer.muted
+}
+
+// next returns the next sample from the source, zero if the source has finished
+//
+func (src *mixerSource) next() (sample float32, done bool) {
+	if src.pos >= len(src.samples) {
+		if !src.loop || len(src.samples) == 0 {
+			return 0, true
+		}
+		src.pos = 0
+	}
+	sample = float32(src.samples[src.pos]) * src.gain
+	src.pos++
+	return sample, false
+}
+
+// softClip limits a summed sample to the 16 bit range, samples above the knee
+// are compressed so that they approach full scale without exceeding it
+//
+func softClip(sample float32) int16 {
+	magnitude := math.Abs(float64(sample))
+	if magnitude > mixerKnee {
+		headroom := math.MaxInt16 - mixerKnee
+		magnitude = mixerKnee + headroom*math.Tanh((magnitude-mixerKnee)/headroom)
+	}
+	if sample < 0 {
+		return int16(-magnitude)
+	}
+	return int16(magnitude)
+}
+
+// Read mixes enough samples to fill the buffer with whole stereo frames of
+// little endian 16 bit samples.  Silence is produced when nothing is playing
+// so a Read will never block, or fail.
+//
+func (mixer *Mixer) Read(p []byte) (n int, errGo error) {
+
+	frames := len(p) / (2 * mixerChannels)
+
+	mixer.Lock()
+	defer mixer.Unlock()
+
+	duckStep := float32(1.0 / (mixerDuckRamp * mixerRate))
+
+	for frame := 0; frame < frames; frame++ {
+
+		// Move the ambient level toward the target a little each frame to avoid
+		// an audible step when effects start and stop
+		target := float32(1.0)
+		if len(mixer.effects) != 0 {
+			target = mixer.Duck
+		}
+		switch {
+		case mixer.duckLevel > target:
+			if mixer.duckLevel -= duckStep; mixer.duckLevel < target {
+				mixer.duckLevel = target
+			}
+		case mixer.duckLevel < target:
+			if mixer.duckLevel += duckStep; mixer.duckLevel > target {
+				mixer.duckLevel = target
+			}
+		}
+
+		for channel := 0; channel < mixerChannels; channel++ {
+			sum := float32(0)
+
+			if mixer.ambient != nil {
+				sample, _ := mixer.ambient.next()
+				sum += sample * mixer.AmbientGain * mixer.duckLevel
+			}
+
+			for _, effect := range mixer.effects {
+				sample, _ := effect.next()
+				sum += sample * mixer.EffectGain
+			}
+
+			out := softClip(sum)
+			if mixer.muted {
+				out = 0
+			}
+			offset := (frame*mixerChannels + channel) * 2
+			p[offset] = byte(out)
+			p[offset+1] = byte(uint16(out) >> 8)
+		}
+
+		// Groom out effects that have completed using
+		// https://github.com/golang/go/wiki/SliceTricks#filtering-without-allocating
+		playing := mixer.effects[:0]
+		for _, effect := range mixer.effects {
+			if effect.pos < len(effect.samples) {
+				playing = append(playing, effect)
+			}
+		}
+		mixer.effects = playing
+	}
+
+	return frames * 2 * mixerChannels, nil
+}
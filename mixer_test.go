@@ -0,0 +1,206 @@
+package mawt
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// constantClip returns a stereo clip with every sample set to the value
+//
+func constantClip(value int16, frames int) (clip []int16) {
+	clip = make([]int16, frames*mixerChannels)
+	for i := range clip {
+		clip[i] = value
+	}
+	return clip
+}
+
+// readMix reads a number of stereo frames from the mixer, returning the left
+// channel which is checked against the right as each frame is read
+//
+func readMix(t *testing.T, mixer *Mixer, frames int) (left []int16) {
+	buffer := make([]byte, frames*mixerChannels*2)
+	n, errGo := mixer.Read(buffer)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if n != len(buffer) {
+		t.Fatalf("read %d bytes rather than %d", n, len(buffer))
+	}
+
+	left = make([]int16, frames)
+	for frame := range left {
+		offset := frame * mixerChannels * 2
+		left[frame] = int16(binary.LittleEndian.Uint16(buffer[offset:]))
+		if right := int16(binary.LittleEndian.Uint16(buffer[offset+2:])); right != left[frame] {
+			t.Fatalf("frame %d had %d on the left and %d on the right", frame, left[frame], right)
+		}
+	}
+	return left
+}
+
+func TestMixerGain(t *testing.T) {
+	mixer := NewMixer(0.5, 2.0, 0.25)
+
+	for frame, sample := range readMix(t, mixer, 10) {
+		if sample != 0 {
+			t.Fatalf("frame %d was %d when nothing was playing", frame, sample)
+		}
+	}
+
+	mixer.SetAmbient(constantClip(1000, 7))
+	for frame, sample := range readMix(t, mixer, 100) {
+		if sample != 500 {
+			t.Fatalf("ambient frame %d was %d rather than 500", frame, sample)
+		}
+	}
+
+	mixer.SetAmbient(nil)
+	mixer.AddEffect(0.5, constantClip(1000, 50))
+	for frame, sample := range readMix(t, mixer, 100) {
+		expected := int16(1000)
+		if frame >= 50 {
+			expected = 0
+		}
+		if sample != expected {
+			t.Fatalf("effect frame %d was %d rather than %d", frame, sample, expected)
+		}
+	}
+
+	// Partial frames are left unread
+	if n, _ := mixer.Read(make([]byte, 2*mixerChannels*3+3)); n != 2*mixerChannels*3 {
+		t.Fatalf("read %d bytes from a buffer holding 3 frames", n)
+	}
+
+	mixer.AddEffect(1.0, constantClip(1000, 50))
+	mixer.SetMuted(true)
+	for frame, sample := range readMix(t, mixer, 10) {
+		if sample != 0 {
+			t.Fatalf("frame %d was %d while muted", frame, sample)
+		}
+	}
+	mixer.SetMuted(false)
+	if sample := readMix(t, mixer, 1)[0]; sample != 2000 {
+		t.Fatalf("the effect did not resume where it would have been, %d", sample)
+	}
+}
+
+func TestMixerDucking(t *testing.T) {
+	mixer := NewMixer(1.0, 1.0, 0.25)
+	mixer.SetAmbient(constantClip(10000, 100))
+
+	if sample := readMix(t, mixer, 1)[0]; sample != 10000 {
+		t.Fatalf("the ambient was %d before any effect", sample)
+	}
+
+	// A silent effect leaves only the ducked ambient in the mix
+	effectFrames := 4000
+	mixer.AddEffect(1.0, constantClip(0, effectFrames))
+
+	rampFrames := int(mixerDuckRamp * mixerRate)
+	maxStep := int(10000/rampFrames) + 1
+
+	mix := readMix(t, mixer, effectFrames)
+	if mix[0] >= 10000 {
+		t.Fatalf("the ambient did not begin to duck, %d", mix[0])
+	}
+	for frame := 1; frame < len(mix); frame++ {
+		step := int(mix[frame-1]) - int(mix[frame])
+		if step < 0 || step > maxStep {
+			t.Fatalf("the ambient stepped by %d at frame %d while ducking", step, frame)
+		}
+	}
+	for frame := rampFrames; frame < len(mix); frame++ {
+		if mix[frame] != 2500 {
+			t.Fatalf("the ambient was %d at frame %d rather than fully ducked", mix[frame], frame)
+		}
+	}
+	if mixer.Playing() != 0 {
+		t.Fatal("the effect was still playing after it finished")
+	}
+
+	mix = readMix(t, mixer, 2*rampFrames)
+	for frame := 1; frame < len(mix); frame++ {
+		step := int(mix[frame]) - int(mix[frame-1])
+		if step < 0 || step > maxStep {
+			t.Fatalf("the ambient stepped by %d at frame %d while recovering", step, frame)
+		}
+	}
+	if mix[len(mix)-1] != 10000 {
+		t.Fatalf("the ambient recovered to %d", mix[len(mix)-1])
+	}
+}
+
+func TestMixerSoftClip(t *testing.T) {
+	for _, sample := range []float32{0, 1000, -1000, mixerKnee, -mixerKnee} {
+		if clipped := softClip(sample); clipped != int16(sample) {
+			t.Fatalf("%f below the knee was changed to %d", sample, clipped)
+		}
+	}
+
+	previous := softClip(mixerKnee)
+	for sample := float32(mixerKnee) + 1000; sample < 8*math.MaxInt16; sample += 1000 {
+		clipped := softClip(sample)
+		if clipped < previous {
+			t.Fatalf("%f was compressed to %d which is below %d", sample, clipped, previous)
+		}
+		if -softClip(-sample) != clipped {
+			t.Fatalf("%f was not compressed symmetrically, %d", sample, softClip(-sample))
+		}
+		previous = clipped
+	}
+
+	mixer := NewMixer(1.0, 1.0, 1.0)
+	mixer.AddEffect(1.0, constantClip(30000, 10))
+	mixer.AddEffect(1.0, constantClip(30000, 10))
+	mixer.AddEffect(1.0, constantClip(math.MinInt16, 10))
+	mixer.AddEffect(1.0, constantClip(math.MinInt16, 10))
+	mixer.AddEffect(1.0, constantClip(math.MinInt16, 10))
+
+	sample := readMix(t, mixer, 1)[0]
+	if float32(sample) >= -mixerKnee || sample == math.MinInt16 {
+		t.Fatalf("the sum of several effects was %d", sample)
+	}
+}
+
+func TestMixerEffects(t *testing.T) {
+	mixer := NewMixer(1.0, 1.0, 1.0)
+
+	// Empty effects are never played
+	mixer.AddEffect(1.0)
+	mixer.AddEffect(1.0, []int16{}, nil)
+	if mixer.Playing() != 0 {
+		t.Fatalf("%d empty effects are playing", mixer.Playing())
+	}
+
+	// Several clips are played one after another
+	mixer.AddEffect(1.0, constantClip(100, 5), constantClip(200, 5))
+	mixer.AddEffect(1.0, constantClip(1000, 20))
+	if mixer.Playing() != 2 {
+		t.Fatalf("%d effects are playing rather than 2", mixer.Playing())
+	}
+
+	mix := readMix(t, mixer, 10)
+	for frame, sample := range mix {
+		expected := int16(1100)
+		if frame >= 5 {
+			expected = 1200
+		}
+		if sample != expected {
+			t.Fatalf("frame %d was %d rather than %d", frame, sample, expected)
+		}
+	}
+	if mixer.Playing() != 1 {
+		t.Fatalf("%d effects are playing after the first finished", mixer.Playing())
+	}
+
+	readMix(t, mixer, 9)
+	if mixer.Playing() != 1 {
+		t.Fatal("the second effect finished early")
+	}
+	readMix(t, mixer, 1)
+	if mixer.Playing() != 0 {
+		t.Fatal("the second effect did not finish")
+	}
+}
@@ -0,0 +1,256 @@
+package model
+
+// This module implements a diff engine that compares consecutive portal
+// status snapshots and produces the semantic events that explain how the
+// portal changed, saving consumers from each having to work this out
+// for themselves
+
+import (
+	"sort"
+	"time"
+)
+
+type EventType string
+
+const (
+	ResonatorDeployed  EventType = "ResonatorDeployed"
+	ResonatorDestroyed EventType = "ResonatorDestroyed"
+	ResonatorUpgraded  EventType = "ResonatorUpgraded"
+	ModAdded           EventType = "ModAdded"
+	ModRemoved         EventType = "ModRemoved"
+	FactionCaptured    EventType = "FactionCaptured"
+	Neutralized        EventType = "Neutralized"
+	HealthDecayed      EventType = "HealthDecayed"
+	HealthRecharged    EventType = "HealthRecharged"
+	LevelChanged       EventType = "LevelChanged"
+)
+
+// EventState holds those attributes of a resonator, mod or portal that are relevant
+// to an event, the Before and After states of an event are only populated with the
+// attributes that apply to the event type
+type EventState struct {
+	Faction string  `json:"faction,omitempty"`
+	Owner   string  `json:"owner,omitempty"`
+	Level   float32 `json:"level,omitempty"`
+	Health  float32 `json:"health,omitempty"`
+	Type    string  `json:"type,omitempty"`
+	Rarity  string  `json:"rarity,omitempty"`
+}
+
+type PortalEvent struct {
+	Type     EventType  `json:"type"`
+	URL      string     `json:"url"`
+	Home     bool       `json:"home"` // Set when delivered for the home portal
+	Time     time.Time  `json:"time"`
+	Position string     `json:"position,omitempty"` // Resonator position for resonator events
+	Slot     float32    `json:"slot,omitempty"`     // Mod slot for mod events
+	Owner    string     `json:"owner,omitempty"`    // The agent associated with the item after the event, or before if it was removed
+	Faction  string     `json:"faction"`            // The controlling faction of the portal after the event
+	Before   EventState `json:"before"`
+	After    EventState `json:"after"`
+}
+
+// resonatorState captures a resonator along with the faction it was deployed by
+func resonatorState(res *Resonator, faction string) EventState {
+	return EventState{
+		Faction: faction,
+		Owner:   res.Owner,
+		Level:   res.Level,
+		Health:  res.Health,
+	}
+}
+
+func modState(mod *Mod) EventState {
+	return EventState{
+		Owner:  mod.Owner,
+		Type:   mod.Type,
+		Rarity: mod.Rarity,
+	}
+}
+
+// compassOrder is used to produce resonator events in a stable order
+var compassOrder = map[string]int{
+	"N": 0, "NE": 1, "E": 2, "SE": 3, "S": 4, "SW": 5, "W": 6, "NW": 7,
+}
+
+// Diff compares two consecutive status snapshots for a portal and returns the events
+// that describe the changes.  When there is no previous status no events are
+// generated as the new status is treated as the baseline.
+//
+// Faction events are returned first, followed by resonator, mod, and lastly
+// portal level events.
+//
+func Diff(url string, prev *Status, next *Status, tm time.Time) (events []*PortalEvent) {
+
+	events = []*PortalEvent{}
+
+	if prev == nil || next == nil {
+		return events
+	}
+
+	add := func(evt *PortalEvent) {
+		evt.URL = url
+		evt.Time = tm
+		evt.Faction = next.Faction
+		events = append(events, evt)
+	}
+
+	factionChange := prev.Faction != next.Faction
+
+	if factionChange {
+		if prev.Faction != "N" && len(prev.Faction) != 0 {
+			add(&PortalEvent{
+				Type:   Neutralized,
+				Owner:  prev.Owner,
+				Before: EventState{Faction: prev.Faction, Owner: prev.Owner},
+				After:  EventState{Faction: "N"},
+			})
+		}
+		if next.Faction != "N" && len(next.Faction) != 0 {
+			add(&PortalEvent{
+				Type:   FactionCaptured,
+				Owner:  next.Owner,
+				Before: EventState{Faction: "N"},
+				After:  EventState{Faction: next.Faction, Owner: next.Owner},
+			})
+		}
+	}
+
+	// Resonators are matched using their positions
+	prevResos := map[string]*Resonator{}
+	for i, res := range prev.Resonators {
+		prevResos[res.Position] = &prev.Resonators[i]
+	}
+	nextResos := map[string]*Resonator{}
+	for i, res := range next.Resonators {
+		nextResos[res.Position] = &next.Resonators[i]
+	}
+
+	positions := []string{}
+	for position := range prevResos {
+		positions = append(positions, position)
+	}
+	for position := range nextResos {
+		if _, isPresent := prevResos[position]; !isPresent {
+			positions = append(positions, position)
+		}
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return compassOrder[positions[i]] < compassOrder[positions[j]]
+	})
+
+	for _, position := range positions {
+		before, wasPresent := prevResos[position]
+		after, isPresent := nextResos[position]
+
+		destroyed := &PortalEvent{Type: ResonatorDestroyed, Position: position}
+		deployed := &PortalEvent{Type: ResonatorDeployed, Position: position}
+
+		switch {
+		case !wasPresent:
+			deployed.Owner = after.Owner
+			deployed.After = resonatorState(after, next.Faction)
+			add(deployed)
+
+		case !isPresent:
+			destroyed.Owner = before.Owner
+			destroyed.Before = resonatorState(before, prev.Faction)
+			add(destroyed)
+
+		case factionChange || after.Level < before.Level || (after.Level == before.Level && after.Owner != before.Owner):
+			// A resonator that has changed hands, or gone down in level, must
+			// have been destroyed and redeployed between the two snapshots
+			destroyed.Owner = before.Owner
+			destroyed.Before = resonatorState(before, prev.Faction)
+			add(destroyed)
+
+			deployed.Owner = after.Owner
+			deployed.After = resonatorState(after, next.Faction)
+			add(deployed)
+
+		case after.Level > before.Level:
+			add(&PortalEvent{
+				Type:     ResonatorUpgraded,
+				Position: position,
+				Owner:    after.Owner,
+				Before:   resonatorState(before, prev.Faction),
+				After:    resonatorState(after, next.Faction),
+			})
+
+		case after.Health < before.Health:
+			add(&PortalEvent{
+				Type:     HealthDecayed,
+				Position: position,
+				Owner:    after.Owner,
+				Before:   resonatorState(before, prev.Faction),
+				After:    resonatorState(after, next.Faction),
+			})
+
+		case after.Health > before.Health:
+			add(&PortalEvent{
+				Type:     HealthRecharged,
+				Position: position,
+				Owner:    after.Owner,
+				Before:   resonatorState(before, prev.Faction),
+				After:    resonatorState(after, next.Faction),
+			})
+		}
+	}
+
+	// Mods are matched using their slots
+	prevMods := map[float32]*Mod{}
+	for i, mod := range prev.Mods {
+		prevMods[mod.Slot] = &prev.Mods[i]
+	}
+	nextMods := map[float32]*Mod{}
+	for i, mod := range next.Mods {
+		nextMods[mod.Slot] = &next.Mods[i]
+	}
+
+	slots := []float32{}
+	for slot := range prevMods {
+		slots = append(slots, slot)
+	}
+	for slot := range nextMods {
+		if _, isPresent := prevMods[slot]; !isPresent {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+
+	for _, slot := range slots {
+		before, wasPresent := prevMods[slot]
+		after, isPresent := nextMods[slot]
+
+		if wasPresent && isPresent && *before == *after {
+			continue
+		}
+		if wasPresent {
+			add(&PortalEvent{
+				Type:   ModRemoved,
+				Slot:   slot,
+				Owner:  before.Owner,
+				Before: modState(before),
+			})
+		}
+		if isPresent {
+			add(&PortalEvent{
+				Type:  ModAdded,
+				Slot:  slot,
+				Owner: after.Owner,
+				After: modState(after),
+			})
+		}
+	}
+
+	if prev.Level != next.Level {
+		add(&PortalEvent{
+			Type:   LevelChanged,
+			Owner:  next.Owner,
+			Before: EventState{Level: prev.Level},
+			After:  EventState{Level: next.Level},
+		})
+	}
+
+	return events
+}
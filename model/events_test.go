@@ -0,0 +1,204 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// summary describes an event briefly enough for the expected events of a
+// test case to be written out in full
+//
+func summary(evt *PortalEvent) (brief string) {
+	switch evt.Type {
+	case ModAdded, ModRemoved:
+		return fmt.Sprintf("%s %v %s", evt.Type, evt.Slot, evt.Owner)
+	case FactionCaptured, Neutralized:
+		return fmt.Sprintf("%s %s>%s %s", evt.Type, evt.Before.Faction, evt.After.Faction, evt.Owner)
+	case LevelChanged:
+		return fmt.Sprintf("%s %v>%v", evt.Type, evt.Before.Level, evt.After.Level)
+	}
+	return fmt.Sprintf("%s %s %s", evt.Type, evt.Position, evt.Owner)
+}
+
+// portal builds a status for a portal held by the faction with the resonators
+// deployed
+//
+func portal(faction string, level float32, resos ...Resonator) (status *Status) {
+	return &Status{
+		Owner:      "owner-" + faction,
+		Faction:    faction,
+		Level:      level,
+		Resonators: resos,
+	}
+}
+
+// reso builds a resonator from its position, level, health, and owner
+//
+func reso(position string, level float32, health float32, owner string) (res Resonator) {
+	return Resonator{Position: position, Level: level, Health: health, Owner: owner}
+}
+
+// withMods sets the mods installed on a portal
+//
+func withMods(status *Status, mods ...Mod) (modded *Status) {
+	status.Mods = mods
+	return status
+}
+
+func TestDiff(t *testing.T) {
+
+	cases := []struct {
+		name   string
+		prev   *Status
+		next   *Status
+		events []string
+	}{
+		{
+			name:   "no previous status",
+			prev:   nil,
+			next:   portal("E", 1, reso("N", 1, 100, "alice")),
+			events: []string{},
+		},
+		{
+			name:   "unchanged",
+			prev:   portal("E", 1, reso("N", 1, 100, "alice")),
+			next:   portal("E", 1, reso("N", 1, 100, "alice")),
+			events: []string{},
+		},
+		{
+			name: "deployed and destroyed in compass order",
+			prev: portal("E", 1, reso("NW", 1, 100, "alice"), reso("S", 1, 100, "alice")),
+			next: portal("E", 1, reso("E", 1, 100, "bob"), reso("S", 1, 100, "alice"), reso("N", 1, 100, "bob")),
+			events: []string{
+				"ResonatorDeployed N bob",
+				"ResonatorDeployed E bob",
+				"ResonatorDestroyed NW alice",
+			},
+		},
+		{
+			name:   "upgraded",
+			prev:   portal("E", 1, reso("NE", 1, 100, "alice")),
+			next:   portal("E", 1, reso("NE", 3, 100, "bob")),
+			events: []string{"ResonatorUpgraded NE bob"},
+		},
+		{
+			name:   "level drop is a destroy and redeploy",
+			prev:   portal("E", 2, reso("SE", 4, 100, "alice")),
+			next:   portal("E", 2, reso("SE", 2, 100, "alice")),
+			events: []string{"ResonatorDestroyed SE alice", "ResonatorDeployed SE alice"},
+		},
+		{
+			name:   "owner change at the same level is a destroy and redeploy",
+			prev:   portal("E", 2, reso("W", 3, 50, "alice")),
+			next:   portal("E", 2, reso("W", 3, 100, "bob")),
+			events: []string{"ResonatorDestroyed W alice", "ResonatorDeployed W bob"},
+		},
+		{
+			name:   "decayed",
+			prev:   portal("R", 1, reso("SW", 2, 100, "carol")),
+			next:   portal("R", 1, reso("SW", 2, 85, "carol")),
+			events: []string{"HealthDecayed SW carol"},
+		},
+		{
+			name:   "recharged",
+			prev:   portal("R", 1, reso("SW", 2, 40, "carol")),
+			next:   portal("R", 1, reso("SW", 2, 100, "carol")),
+			events: []string{"HealthRecharged SW carol"},
+		},
+		{
+			name:   "neutralized",
+			prev:   portal("E", 1, reso("N", 1, 10, "alice")),
+			next:   portal("N", 0),
+			events: []string{"Neutralized E>N owner-E", "ResonatorDestroyed N alice", "LevelChanged 1>0"},
+		},
+		{
+			name:   "captured from neutral",
+			prev:   portal("N", 0),
+			next:   portal("R", 1, reso("N", 1, 100, "carol")),
+			events: []string{"FactionCaptured N>R owner-R", "ResonatorDeployed N carol", "LevelChanged 0>1"},
+		},
+		{
+			name: "direct flip synthesizes both faction events and redeploys every resonator",
+			prev: portal("E", 1, reso("N", 1, 100, "alice"), reso("S", 1, 100, "alice")),
+			next: portal("R", 1, reso("N", 1, 100, "carol"), reso("S", 2, 100, "carol")),
+			events: []string{
+				"Neutralized E>N owner-E",
+				"FactionCaptured N>R owner-R",
+				"ResonatorDestroyed N alice",
+				"ResonatorDeployed N carol",
+				"ResonatorDestroyed S alice",
+				"ResonatorDeployed S carol",
+			},
+		},
+		{
+			name: "mods are compared by slot",
+			prev: withMods(portal("E", 1),
+				Mod{Slot: 1, Owner: "alice", Type: "HS", Rarity: "C"},
+				Mod{Slot: 2, Owner: "alice", Type: "PS", Rarity: "R"},
+				Mod{Slot: 4, Owner: "alice", Type: "FA", Rarity: "C"}),
+			next: withMods(portal("E", 1),
+				Mod{Slot: 2, Owner: "alice", Type: "PS", Rarity: "R"},
+				Mod{Slot: 3, Owner: "bob", Type: "T", Rarity: "VR"},
+				Mod{Slot: 4, Owner: "bob", Type: "FA", Rarity: "C"},
+				Mod{Slot: 1, Owner: "alice", Type: "HS", Rarity: "C"}),
+			events: []string{
+				"ModAdded 3 bob",
+				"ModRemoved 4 alice",
+				"ModAdded 4 bob",
+			},
+		},
+		{
+			name: "faction, resonator, mod, and level events are ordered",
+			prev: withMods(portal("N", 0)),
+			next: withMods(portal("E", 2, reso("E", 2, 100, "alice"), reso("N", 2, 100, "alice")),
+				Mod{Slot: 1, Owner: "alice", Type: "HS", Rarity: "C"}),
+			events: []string{
+				"FactionCaptured N>E owner-E",
+				"ResonatorDeployed N alice",
+				"ResonatorDeployed E alice",
+				"ModAdded 1 alice",
+				"LevelChanged 0>2",
+			},
+		},
+	}
+
+	tm := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range cases {
+		events := Diff("http://tecthulhu", tc.prev, tc.next, tm)
+
+		got := []string{}
+		for _, evt := range events {
+			got = append(got, summary(evt))
+
+			if evt.URL != "http://tecthulhu" || !evt.Time.Equal(tm) || evt.Faction != tc.next.Faction {
+				t.Errorf("%s: %s was not stamped with the url, time, and faction of the portal", tc.name, summary(evt))
+			}
+		}
+		if !reflect.DeepEqual(got, tc.events) {
+			t.Errorf("%s: got %q, expected %q", tc.name, got, tc.events)
+		}
+	}
+}
+
+// TestDiffStates checks the before and after states carried by resonator events
+//
+func TestDiffStates(t *testing.T) {
+	prev := portal("E", 1, reso("N", 4, 60, "alice"))
+	next := portal("R", 1, reso("N", 2, 100, "carol"))
+
+	events := Diff("http://tecthulhu", prev, next, time.Now())
+	if len(events) != 4 {
+		t.Fatalf("got %d events rather than 4", len(events))
+	}
+
+	destroyed, deployed := events[2], events[3]
+	if expected := (EventState{Faction: "E", Owner: "alice", Level: 4, Health: 60}); destroyed.Before != expected || destroyed.After != (EventState{}) {
+		t.Errorf("destroyed resonator had %+v before and %+v after", destroyed.Before, destroyed.After)
+	}
+	if expected := (EventState{Faction: "R", Owner: "carol", Level: 2, Health: 100}); deployed.After != expected || deployed.Before != (EventState{}) {
+		t.Errorf("deployed resonator had %+v before and %+v after", deployed.Before, deployed.After)
+	}
+}
@@ -0,0 +1,30 @@
+package model
+
+// This module defines the messages used to report on the connectivity of
+// the gateway with the tecthulhu devices it is monitoring
+
+import (
+	"time"
+)
+
+// HealthState is the liveness of the connection to a tecthulhu
+type HealthState string
+
+const (
+	HealthConnecting HealthState = "connecting" // No status has yet been received from the device
+	HealthOnline     HealthState = "online"     // The last status check succeeded
+	HealthStale      HealthState = "stale"      // Recent status checks failed, the last status is being retained
+	HealthOffline    HealthState = "offline"    // The device has not answered for long enough that its status is unknown
+)
+
+// HealthMsg is published whenever the liveness of a tecthulhu changes
+type HealthMsg struct {
+	URL      string      `json:"url"`
+	Home     bool        `json:"home"` // Set when delivered for the home portal
+	State    HealthState `json:"state"`
+	Previous HealthState `json:"previous"`
+	Since    time.Time   `json:"since"`    // When the device entered the current state
+	LastSeen time.Time   `json:"lastSeen"` // When the last good status was received, zero if never
+	Failures int         `json:"failures"` // The number of consecutive failed status checks
+	Error    string      `json:"error,omitempty"`
+}
@@ -38,8 +38,11 @@ type PortalStatus struct {
 }
 
 type PortalMsg struct {
-	Home   bool   `json:"home"`
-	Status Status `json:"externalApiPortal"`
+	URL      string `json:"url"`
+	Home     bool   `json:"home"`               // Set when delivered for the home portal
+	Seq      uint64 `json:"seq"`                // Incremented each time the status of the portal changes
+	Injected bool   `json:"injected,omitempty"` // Set when supplied by an operator, the Seq is then that of the last status from the tecthulhu
+	Status   Status `json:"externalApiPortal"`
 }
 
 // DeepCopy deepcopies a to b using json marshaling
@@ -0,0 +1,209 @@
+package mawt
+
+// This module implements a managed connection to a fadecandy, or other OPC,
+// server.  The connection is made in the background and remade with an
+// increasing delay whenever it is lost, allowing fcserver to be started after
+// the gateway or to be restarted during an event.
+//
+// Lost connections are detected in three ways.  Writes have a deadline so that
+// a server that has stopped reading causes the connection to be dropped rather
+// than the frame loop stalling, OPC servers never send data to their clients so
+// any read completing indicates the server has closed or reset the connection,
+// and TCP keep alives are used to notice a server that has disappeared without
+// closing the connection while no frames are being sent.
+
+import (
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	"github.com/kellydunn/go-opc"
+)
+
+var (
+	// ErrOPCOffline is the cause of errors returned when a message is sent while
+	// there is no connection to the OPC server, the loss of the connection will
+	// have already been reported
+	ErrOPCOffline = errors.New("fadecandy server not online")
+)
+
+const (
+	opcDialTimeout  = time.Duration(2 * time.Second)
+	opcWriteTimeout = time.Duration(250 * time.Millisecond)
+	opcKeepAlive    = time.Duration(5 * time.Second)
+
+	opcMinRetry = time.Duration(250 * time.Millisecond)
+	opcMaxRetry = time.Duration(10 * time.Second)
+)
+
+// opcLink manages the connection to an OPC server
+//
+type opcLink struct {
+	server string
+
+	conn     net.Conn
+	failure  error  // The reason the current connection was dropped by a sender
+	connects uint64 // The number of times a connection has been made
+
+	stats *expvar.Map // Measures the traffic sent, shared by the links of a FadeCandy
+
+	sync.Mutex
+}
+
+func newOPCLink(server string, stats *expvar.Map) (link *opcLink) {
+	return &opcLink{
+		server: server,
+		stats:  stats,
+	}
+}
+
+// online is used to determine if the link currently has a connection to the server
+//
+func (link *opcLink) online() (isOnline bool) {
+	link.Lock()
+	defer link.Unlock()
+	return link.conn != nil
+}
+
+// generation changes each time a new connection is made to the server, a server that
+// has been reconnected to may have lost the state of the LEDs
+//
+func (link *opcLink) generation() (connects uint64) {
+	link.Lock()
+	defer link.Unlock()
+	return link.connects
+}
+
+// encodeOPC builds a set pixel colors message for a channel from RGB data, three bytes
+// per pixel
+//
+func encodeOPC(channel uint8, rgb []byte) (data []byte) {
+	data = make([]byte, 4, 4+len(rgb))
+	data[0] = channel
+	data[1] = opc.SET_PIXEL_COLORS
+	data[2] = byte(len(rgb) >> 8)
+	data[3] = byte(len(rgb))
+	return append(data, rgb...)
+}
+
+// write sends an encoded message to the server.  When the write fails the connection
+// is dropped and the link will begin reconnecting.
+//
+func (link *opcLink) write(data []byte) (err errors.Error) {
+	link.Lock()
+	conn := link.conn
+	link.Unlock()
+
+	if conn == nil {
+		return errors.Wrap(ErrOPCOffline).With("server", link.server).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if errGo := conn.SetWriteDeadline(time.Now().Add(opcWriteTimeout)); errGo != nil {
+		link.drop(conn, errGo)
+		return errors.Wrap(errGo).With("server", link.server).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo := conn.Write(data); errGo != nil {
+		link.drop(conn, errGo)
+		return errors.Wrap(errGo).With("server", link.server).With("stack", stack.Trace().TrimRuntime())
+	}
+	link.stats.Add("writes", 1)
+	link.stats.Add("bytes", int64(len(data)))
+	return nil
+}
+
+// drop closes the connection if it is still the current one, a write that has
+// partially completed leaves the OPC stream unframed so the connection cannot be
+// used again
+//
+func (link *opcLink) drop(conn net.Conn, failure error) {
+	link.Lock()
+	defer link.Unlock()
+
+	if link.conn != conn {
+		return
+	}
+	link.conn = nil
+	if link.failure == nil {
+		link.failure = failure
+	}
+	conn.Close()
+}
+
+// run connects to the server and watches the connection, reconnecting with an
+// increasing delay after it is lost until the quitC is closed.  Changes in the
+// connection state are reported using the errorC.
+//
+func (link *opcLink) run(errorC chan<- errors.Error, quitC <-chan struct{}) {
+
+	retry := opcMinRetry
+
+	for {
+		conn, errGo := net.DialTimeout("tcp", link.server, opcDialTimeout)
+		err := errors.Error(nil)
+
+		if errGo != nil {
+			err = errors.Wrap(errGo, "fadecandy server connection failed").With("server", link.server).With("retry", retry.String()).With("stack", stack.Trace().TrimRuntime())
+		} else {
+			retry = opcMinRetry
+
+			if tcp, isTCP := conn.(*net.TCPConn); isTCP {
+				tcp.SetKeepAlive(true)
+				tcp.SetKeepAlivePeriod(opcKeepAlive)
+				tcp.SetNoDelay(true)
+			}
+
+			link.Lock()
+			link.conn = conn
+			link.failure = nil
+			link.connects++
+			link.Unlock()
+
+			sendErr(errorC, errors.New("fadecandy server connected").With("server", link.server).With("stack", stack.Trace().TrimRuntime()))
+
+			// Anything arriving from the server is discarded, the read only completes
+			// once the connection has been closed from either end
+			readC := make(chan error, 1)
+			go func() {
+				_, errGo := io.Copy(ioutil.Discard, conn)
+				readC <- errGo
+			}()
+
+			select {
+			case errGo = <-readC:
+			case <-quitC:
+				link.drop(conn, nil)
+				return
+			}
+
+			link.drop(conn, errGo)
+
+			link.Lock()
+			failure := link.failure
+			link.Unlock()
+
+			if failure == nil {
+				err = errors.New("fadecandy server closed the connection").With("server", link.server).With("stack", stack.Trace().TrimRuntime())
+			} else {
+				err = errors.Wrap(failure, "fadecandy server connection lost").With("server", link.server).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+
+		sendErr(errorC, err)
+
+		select {
+		case <-time.After(retry):
+		case <-quitC:
+			return
+		}
+
+		if retry *= 2; retry > opcMaxRetry {
+			retry = opcMaxRetry
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package mawt
+
+// This module implements the routing of OPC messages to one of several OPC
+// servers using the channel of each message, allowing the strands to be
+// spread across more than one fadecandy server.
+//
+// Routes are specified as a comma separated list of channel ranges and
+// servers, for example "1-8=base:7890,9-24=tower:7890".  An entry without a
+// channel range, for example "127.0.0.1:7890", receives the messages for any
+// channels not otherwise routed.
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	"github.com/kellydunn/go-opc"
+)
+
+// opcRoute sends a range of channels, inclusive, to a server
+type opcRoute struct {
+	first animationModel.OpcChannel
+	last  animationModel.OpcChannel
+	link  *opcLink
+}
+
+// opcRouter holds a connection for each server along with the routes that
+// use them
+//
+type opcRouter struct {
+	links    map[string]*opcLink
+	routes   []opcRoute
+	fallback *opcLink
+
+	unrouted map[uint8]bool // Channels that have been reported as having no route
+	sync.Mutex
+}
+
+// parseChannels parses a single channel, or an inclusive range of channels such as 1-8
+//
+func parseChannels(spec string) (first animationModel.OpcChannel, last animationModel.OpcChannel, err errors.Error) {
+	bounds := strings.SplitN(spec, "-", 2)
+	if len(bounds) == 1 {
+		bounds = append(bounds, bounds[0])
+	}
+
+	values := [2]int{}
+	for i, bound := range bounds {
+		value, errGo := strconv.Atoi(strings.TrimSpace(bound))
+		if errGo != nil {
+			return 0, 0, errors.Wrap(errGo).With("channels", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+		// Channel 0 is the OPC broadcast channel and is sent to every server
+		if value < 1 || value > 255 {
+			errGo = fmt.Errorf("OPC channels must be between 1 and 255")
+			return 0, 0, errors.Wrap(errGo).With("channels", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+		values[i] = value
+	}
+	if values[0] > values[1] {
+		errGo := fmt.Errorf("OPC channel range is reversed")
+		return 0, 0, errors.Wrap(errGo).With("channels", spec).With("stack", stack.Trace().TrimRuntime())
+	}
+	return animationModel.OpcChannel(values[0]), animationModel.OpcChannel(values[1]), nil
+}
+
+// newOPCRouter creates the connections and routes for a routing specification, the
+// connections are not started until run is called.  The traffic sent over every
+// connection is counted using the stats.
+//
+func newOPCRouter(spec string, stats *expvar.Map) (router *opcRouter, err errors.Error) {
+
+	router = &opcRouter{
+		links:    map[string]*opcLink{},
+		routes:   []opcRoute{},
+		unrouted: map[uint8]bool{},
+	}
+
+	linkFor := func(server string) (link *opcLink) {
+		if link, isPresent := router.links[server]; isPresent {
+			return link
+		}
+		link = newOPCLink(server, stats)
+		router.links[server] = link
+		return link
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			if router.fallback != nil {
+				errGo := fmt.Errorf("only one OPC server can be used for unrouted channels")
+				return nil, errors.Wrap(errGo).With("routes", spec).With("stack", stack.Trace().TrimRuntime())
+			}
+			router.fallback = linkFor(entry)
+			continue
+		}
+
+		first, last, err := parseChannels(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		server := strings.TrimSpace(parts[1])
+		if len(server) == 0 {
+			errGo := fmt.Errorf("OPC route is missing the server")
+			return nil, errors.Wrap(errGo).With("route", entry).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		for _, route := range router.routes {
+			if first <= route.last && last >= route.first {
+				errGo := fmt.Errorf("OPC routes have overlapping channels")
+				return nil, errors.Wrap(errGo).With("route", entry).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+
+		router.routes = append(router.routes, opcRoute{
+			first: first,
+			last:  last,
+			link:  linkFor(server),
+		})
+	}
+
+	if len(router.links) == 0 {
+		errGo := fmt.Errorf("no OPC servers were specified")
+		return nil, errors.Wrap(errGo).With("routes", spec).With("stack", stack.Trace().TrimRuntime())
+	}
+	return router, nil
+}
+
+// run starts the connection to each of the servers, each connection reports
+// its own state using the errorC
+//
+func (router *opcRouter) run(errorC chan<- errors.Error, quitC <-chan struct{}) {
+	for _, link := range router.links {
+		go link.run(errorC, quitC)
+	}
+}
+
+// route returns the connection that the channel is sent to, or nil if it has no route
+//
+func (router *opcRouter) route(channel uint8) (link *opcLink) {
+	for _, route := range router.routes {
+		if animationModel.OpcChannel(channel) >= route.first && animationModel.OpcChannel(channel) <= route.last {
+			return route.link
+		}
+	}
+	return router.fallback
+}
+
+// generation changes whenever any of the servers has been reconnected to
+//
+func (router *opcRouter) generation() (connects uint64) {
+	for _, link := range router.links {
+		connects += link.generation()
+	}
+	return connects
+}
+
+// SendBatch writes a set of encoded messages to the servers using a single write
+// per server.  Broadcast messages are sent to every server, and messages for channels
+// without a route are discarded with an error being returned the first time the
+// channel is seen.  The servers whose write failed are returned so that the caller
+// knows which messages did not arrive.
+//
+func (router *opcRouter) SendBatch(msgs [][]byte) (failed map[*opcLink]bool, err errors.Error) {
+
+	failed = map[*opcLink]bool{}
+	batches := map[*opcLink][]byte{}
+
+	for _, msg := range msgs {
+		if len(msg) < 4 {
+			return failed, errors.New("invalid message").With("stack", stack.Trace().TrimRuntime())
+		}
+
+		channel := msg[0]
+		if channel == opc.BROADCAST_CHANNEL {
+			for _, link := range router.links {
+				batches[link] = append(batches[link], msg...)
+			}
+			continue
+		}
+
+		link := router.route(channel)
+		if link == nil {
+			router.Lock()
+			if !router.unrouted[channel] {
+				router.unrouted[channel] = true
+				err = errors.New("no OPC server is routed for channel").With("channel", channel).With("stack", stack.Trace().TrimRuntime())
+			}
+			router.Unlock()
+			continue
+		}
+		batches[link] = append(batches[link], msg...)
+	}
+
+	// Errors other than the server being offline are more interesting to the caller
+	for link, batch := range batches {
+		if errLink := link.write(batch); errLink != nil {
+			failed[link] = true
+			if err == nil || errors.Cause(err) == ErrOPCOffline {
+				err = errLink
+			}
+		}
+	}
+	return failed, err
+}
+
+// Send writes a message to the server that the channel of the message is routed
+// to.  Broadcast messages are sent to every server.  Messages for channels without
+// a route are discarded with an error being returned the first time it is seen.
+//
+func (router *opcRouter) Send(m *opc.Message) (err errors.Error) {
+	if m == nil {
+		return errors.New("invalid message").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	data := m.ByteArray()
+	channel := data[0]
+
+	if m.IsBroadcast() {
+		for _, link := range router.links {
+			if errLink := link.write(data); errLink != nil {
+				err = errLink
+			}
+		}
+		return err
+	}
+
+	link := router.route(channel)
+	if link == nil {
+		router.Lock()
+		defer router.Unlock()
+
+		if router.unrouted[channel] {
+			return nil
+		}
+		router.unrouted[channel] = true
+		return errors.New("no OPC server is routed for channel").With("channel", channel).With("stack", stack.Trace().TrimRuntime())
+	}
+	return link.write(data)
+}
@@ -0,0 +1,199 @@
+package mawt
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/karlmutch/errors"
+
+	"github.com/kellydunn/go-opc"
+)
+
+// opcTestDevice reports each message the OPC server receives on its output so
+// that the test driving the server can see what arrived
+//
+type opcTestDevice struct{}
+
+func (dev *opcTestDevice) Channel() uint8 {
+	return 0
+}
+
+func (dev *opcTestDevice) Write(msg *opc.Message) (errGo error) {
+	data := msg.ByteArray()
+	fmt.Printf("opc %d %d\n", data[0], len(data)-opc.HEADER_BYTES)
+	return nil
+}
+
+// TestOPCServerProcess is not a test, it is run by TestOPCLink in a child process
+// that stands in for fcserver so that the server can be killed, and stopped
+//
+func TestOPCServerProcess(t *testing.T) {
+	addr := os.Getenv("MAWT_TEST_OPC_SERVER")
+	if len(addr) == 0 {
+		t.Skip("only run as the OPC server for TestOPCLink")
+	}
+
+	server := opc.NewServer()
+	server.RegisterDevice(&opcTestDevice{})
+	go server.Process()
+	server.ListenOnPort("tcp", addr)
+}
+
+// startOPCServer runs an OPC server listening on the address, the messages received
+// by the server are sent to the returned channel
+//
+func startOPCServer(t *testing.T, addr string) (cmd *exec.Cmd, msgC chan string) {
+	cmd = exec.Command(os.Args[0], "-test.run=^TestOPCServerProcess$")
+	cmd.Env = append(os.Environ(), "MAWT_TEST_OPC_SERVER="+addr)
+	out, errGo := cmd.StdoutPipe()
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = cmd.Start(); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	msgC = make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "opc ") {
+				msgC <- strings.TrimPrefix(line, "opc ")
+			}
+		}
+	}()
+	return cmd, msgC
+}
+
+func killOPCServer(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+// waitOPCLink waits for the link to have made the expected number of connections
+//
+func waitOPCLink(t *testing.T, link *opcLink, connects uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if link.online() && link.generation() == connects {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the link did not make connection %d, %d were made", connects, link.generation())
+}
+
+// waitOPCReport waits for the link to report a change in the state of the connection
+//
+func waitOPCReport(t *testing.T, errorC chan errors.Error, report string) {
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case err := <-errorC:
+			if strings.Contains(err.Error(), report) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("the link did not report %q", report)
+		}
+	}
+}
+
+// sendOPC writes a message to the link and checks it was received by the server
+//
+func sendOPC(t *testing.T, link *opcLink, msgC chan string) {
+	if err := link.write(encodeOPC(0, []byte{1, 2, 3, 4, 5, 6})); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-msgC:
+		if msg != "0 6" {
+			t.Fatalf("the server received %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not receive the message")
+	}
+}
+
+func TestOPCLink(t *testing.T) {
+
+	// Find a port that can be reused by each server that is started
+	listener, errGo := net.Listen("tcp", "127.0.0.1:0")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	server, msgC := startOPCServer(t, addr)
+	defer killOPCServer(server)
+
+	link := newOPCLink(addr, new(expvar.Map).Init())
+	if err := link.write(encodeOPC(0, []byte{1, 2, 3})); errors.Cause(err) != ErrOPCOffline {
+		t.Fatalf("a write before connecting returned %v", err)
+	}
+
+	errorC := make(chan errors.Error, 100)
+	quitC := make(chan struct{})
+	defer close(quitC)
+
+	go link.run(errorC, quitC)
+
+	waitOPCLink(t, link, 1)
+	waitOPCReport(t, errorC, "fadecandy server connected")
+	sendOPC(t, link, msgC)
+
+	// Killing the server is noticed without anything being written
+	killOPCServer(server)
+	waitOPCReport(t, errorC, "fadecandy server closed the connection")
+	if link.online() {
+		t.Fatal("the link was online after the server was killed")
+	}
+	if err := link.write(encodeOPC(0, []byte{1, 2, 3})); errors.Cause(err) != ErrOPCOffline {
+		t.Fatalf("a write after the server was killed returned %v", err)
+	}
+
+	// A restarted server is reconnected to as a new generation
+	server, msgC = startOPCServer(t, addr)
+	defer killOPCServer(server)
+
+	waitOPCLink(t, link, 2)
+	waitOPCReport(t, errorC, "fadecandy server connected")
+	sendOPC(t, link, msgC)
+
+	// A server that stops reading causes a write to miss its deadline, rather than
+	// blocking, and the connection is dropped
+	if errGo = server.Process.Signal(syscall.SIGSTOP); errGo != nil {
+		t.Fatal(errGo)
+	}
+	frame := encodeOPC(0, make([]byte, 60000))
+	for i := 0; ; i++ {
+		if i > 10000 {
+			t.Fatal("writes continued to succeed after the server was stopped")
+		}
+		started := time.Now()
+		err := link.write(frame)
+		if err == nil {
+			continue
+		}
+		if elapsed := time.Since(started); elapsed > opcWriteTimeout+time.Second {
+			t.Fatalf("the write took %v to fail", elapsed)
+		}
+		if netErr, isNet := errors.Cause(err).(net.Error); !isNet || !netErr.Timeout() {
+			t.Fatalf("the write failed with %v rather than a timeout", err)
+		}
+		break
+	}
+	if link.generation() != 2 {
+		t.Fatalf("the link is at generation %d rather than 2", link.generation())
+	}
+	waitOPCReport(t, errorC, "fadecandy server connection lost")
+}
@@ -0,0 +1,171 @@
+package mawt
+
+// This module retains the last status and health of every tecthulhu known to a
+// Gateway so that they can be inspected while mawt is running, and so that
+// operators can inject a status for a portal as though it had been reported
+// by its tecthulhu.
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// PortalState is what is known about a tecthulhu and its portal
+//
+type PortalState struct {
+	URL     string           `json:"url"`
+	Home    bool             `json:"home"`
+	Seq     uint64           `json:"seq"`              // Incremented each time the status of the portal changes
+	Status  *model.Status    `json:"status,omitempty"` // The last status, nil until one has been received
+	Health  *model.HealthMsg `json:"health,omitempty"` // The last change in liveness of the tecthulhu
+	Updated time.Time        `json:"updated"`          // When the last status was received
+}
+
+// portalCache follows the statuses and health published for each tecthulhu
+//
+type portalCache struct {
+	fanout  *FanOut
+	urls    []string // The tecthulhus in the order they were configured, or first seen
+	portals map[string]*PortalState
+	sync.Mutex
+}
+
+// newPortalCache subscribes to the fan-out, the tecthulhus configured for the home
+// portal are known from the start so that they are listed before reporting
+//
+func newPortalCache(fanout *FanOut, home HomeConfig, quitC <-chan struct{}) (cache *portalCache) {
+	cache = &portalCache{
+		fanout:  fanout,
+		urls:    []string{},
+		portals: map[string]*PortalState{},
+	}
+	for _, url := range home.URLs {
+		cache.portal(url)
+	}
+
+	ctx, unsubscribe := context.WithCancel(context.Background())
+	sub := fanout.Subscribe(ctx, "portals", Filter{Topics: []Topic{TopicStatus, TopicHealth}},
+		Queue{Size: statusBacklog, Policy: CoalesceLatest})
+
+	go func() {
+		defer unsubscribe()
+		for {
+			select {
+			case msg := <-sub.C:
+				cache.update(msg, time.Now())
+			case <-quitC:
+				return
+			}
+		}
+	}()
+	return cache
+}
+
+// portal returns the record for a tecthulhu, adding it if necessary, the caller is
+// expected to hold the lock once the cache is in use
+//
+func (cache *portalCache) portal(url string) (portal *PortalState) {
+	if portal, isPresent := cache.portals[url]; isPresent {
+		return portal
+	}
+	portal = &PortalState{URL: url}
+	cache.portals[url] = portal
+	cache.urls = append(cache.urls, url)
+	return portal
+}
+
+func (cache *portalCache) update(msg *Message, now time.Time) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	portal := cache.portal(msg.URL)
+
+	switch msg.Topic {
+	case TopicStatus:
+		portal.Seq = msg.Status.Seq
+		portal.Status = msg.Status.Status.DeepCopy()
+		portal.Updated = now
+	case TopicHealth:
+		health := *msg.Health
+		portal.Health = &health
+	}
+}
+
+// snapshot returns copies of what is known about each tecthulhu
+//
+func (cache *portalCache) snapshot() (portals []PortalState) {
+	home, _ := cache.fanout.Home()
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	portals = make([]PortalState, 0, len(cache.urls))
+	for _, url := range cache.urls {
+		portal := *cache.portals[url]
+		portal.Home = url == home
+		if portal.Status != nil {
+			portal.Status = portal.Status.DeepCopy()
+		}
+		if portal.Health != nil {
+			health := *portal.Health
+			portal.Health = &health
+		}
+		portals = append(portals, portal)
+	}
+	return portals
+}
+
+// inject publishes a status for a tecthulhu, along with the events describing how it
+// differs from the previous status, as though it had been reported by the tecthulhu.
+// An empty url is taken to be the home portal.  The injected status is shown until
+// the tecthulhu is next checked.  Injected statuses are kept out of the sequence of
+// the tecthulhu, they carry the sequence number of its last status.
+//
+func (cache *portalCache) inject(url string, status *model.Status) (err errors.Error) {
+	if len(url) == 0 {
+		url, _ = cache.fanout.Home()
+	}
+	if status == nil {
+		return errors.New("no status was supplied").With("url", url).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	faction, isKnown := FactionCode(status.Faction)
+	if !isKnown {
+		return errors.New("unknown faction").With("faction", status.Faction).With("stack", stack.Trace().TrimRuntime())
+	}
+	injected := status.DeepCopy()
+	injected.Faction = faction
+
+	cache.Lock()
+	portal, isPresent := cache.portals[url]
+	if !isPresent {
+		cache.Unlock()
+		return errors.New("the portal is not one of the tecthulhus").With("url", url).With("stack", stack.Trace().TrimRuntime())
+	}
+	previous := portal.Status
+	seq := portal.Seq
+	cache.Unlock()
+
+	msg := &model.PortalMsg{
+		URL:      url,
+		Seq:      seq,
+		Injected: true,
+		Status:   *injected,
+	}
+	if err = cache.fanout.PublishStatus(msg); err != nil {
+		return err
+	}
+
+	for _, event := range model.Diff(url, previous, injected, time.Now()) {
+		if err = cache.fanout.PublishEvent(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package mawt
+
+// This module implements the recording of the frames drawn by the animation
+// into a file, and the reading of those recordings so that they can be played
+// back to the LEDs after the event, see replay.go.
+//
+// A recording is a gzip compressed stream starting with the 8 byte magic
+// "MAWTREC1" and the time the recording was started as unix nanoseconds,
+// encoded as a uvarint.  Each frame that follows is made up of
+//
+//	uvarint  microseconds since the previous frame
+//	uvarint  number of channels
+//	for each channel
+//	    uvarint  OPC channel
+//	    uvarint  number of pixels
+//	    bytes    red, green, blue for each pixel
+//
+// The compressed stream is flushed regularly so that a recording cut short by
+// the process being stopped is only missing its last few frames.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"image/color"
+	"io"
+	"os"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	recordingMagic = "MAWTREC1"
+
+	// How often buffered frames are written through to the recording file
+	recordingFlushInterval = time.Duration(time.Second)
+
+	// Limits used to reject damaged recordings rather than allocating without bound
+	recordingMaxChannels = 256
+	recordingMaxPixels   = 64 * 1024
+)
+
+// FrameRecorder writes timestamped frames into a recording file
+//
+type FrameRecorder struct {
+	fn     string
+	file   *os.File
+	zip    *gzip.Writer
+	out    *bufio.Writer
+	last   time.Time // The time of the previous frame, or the start of the recording
+	flush  time.Time
+	frames uint64
+}
+
+// NewFrameRecorder creates, or truncates, the recording file
+//
+func NewFrameRecorder(fn string) (rec *FrameRecorder, err errors.Error) {
+	file, errGo := os.Create(fn)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	now := time.Now()
+	rec = &FrameRecorder{
+		fn:    fn,
+		file:  file,
+		zip:   gzip.NewWriter(file),
+		last:  now,
+		flush: now,
+	}
+	rec.out = bufio.NewWriter(rec.zip)
+
+	if _, errGo = rec.out.WriteString(recordingMagic); errGo == nil {
+		errGo = putUvarint(rec.out, uint64(now.UnixNano()))
+	}
+	if errGo != nil {
+		file.Close()
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return rec, nil
+}
+
+func putUvarint(w *bufio.Writer, value uint64) (errGo error) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, errGo = w.Write(buf[:binary.PutUvarint(buf, value)])
+	return errGo
+}
+
+// Record appends a frame drawn at the time tm to the recording
+//
+func (rec *FrameRecorder) Record(tm time.Time, frame []animationModel.ChannelData) (err errors.Error) {
+	errGo := func() (errGo error) {
+		// Frames are never recorded as happening before those already in the file
+		delta := tm.Sub(rec.last)
+		if delta < 0 {
+			delta = 0
+		}
+		rec.last = rec.last.Add(delta)
+
+		if errGo = putUvarint(rec.out, uint64(delta/time.Microsecond)); errGo != nil {
+			return errGo
+		}
+		if errGo = putUvarint(rec.out, uint64(len(frame))); errGo != nil {
+			return errGo
+		}
+		for _, channel := range frame {
+			if errGo = putUvarint(rec.out, uint64(channel.ChannelNum)); errGo != nil {
+				return errGo
+			}
+			if errGo = putUvarint(rec.out, uint64(len(channel.Data))); errGo != nil {
+				return errGo
+			}
+			for _, pixel := range channel.Data {
+				r, g, b := toRGB(pixel)
+				if _, errGo = rec.out.Write([]byte{r, g, b}); errGo != nil {
+					return errGo
+				}
+			}
+		}
+		rec.frames++
+
+		if tm.Sub(rec.flush) >= recordingFlushInterval {
+			rec.flush = tm
+			if errGo = rec.out.Flush(); errGo != nil {
+				return errGo
+			}
+			return rec.zip.Flush()
+		}
+		return nil
+	}()
+
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", rec.fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// Close writes any buffered frames and closes the recording file
+//
+func (rec *FrameRecorder) Close() (err errors.Error) {
+	errGo := rec.out.Flush()
+	if errGoZip := rec.zip.Close(); errGo == nil {
+		errGo = errGoZip
+	}
+	if errGoFile := rec.file.Close(); errGo == nil {
+		errGo = errGoFile
+	}
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", rec.fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// FrameReader returns the frames held in a recording in the order they were recorded
+//
+type FrameReader struct {
+	fn    string
+	file  *os.File
+	zip   *gzip.Reader
+	in    *bufio.Reader
+	Start time.Time // The time at which the recording was started
+}
+
+// OpenRecording opens a recording file and reads its header
+//
+func OpenRecording(fn string) (rdr *FrameReader, err errors.Error) {
+	file, errGo := os.Open(fn)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	zip, errGo := gzip.NewReader(file)
+	if errGo != nil {
+		file.Close()
+		return nil, errors.Wrap(errGo, "not a mawt recording").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	rdr = &FrameReader{
+		fn:   fn,
+		file: file,
+		zip:  zip,
+		in:   bufio.NewReader(zip),
+	}
+
+	magic := make([]byte, len(recordingMagic))
+	if _, errGo = io.ReadFull(rdr.in, magic); errGo != nil || string(magic) != recordingMagic {
+		rdr.Close()
+		return nil, errors.New("not a mawt recording").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	start, errGo := binary.ReadUvarint(rdr.in)
+	if errGo != nil {
+		rdr.Close()
+		return nil, errors.Wrap(errGo, "recording header is incomplete").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	rdr.Start = time.Unix(0, int64(start))
+
+	return rdr, nil
+}
+
+// Next returns the next frame and the time since the previous frame, or the start
+// of the recording for the first frame.  A nil frame
+// is returned once the recording has been completely read.  A recording whose
+// last frame is incomplete, as happens when mawt is stopped abruptly, is treated
+// as ending before that frame.
+//
+func (rdr *FrameReader) Next() (delta time.Duration, frame []animationModel.ChannelData, err errors.Error) {
+	micros, errGo := binary.ReadUvarint(rdr.in)
+	if errGo != nil {
+		if errGo == io.EOF || errGo == io.ErrUnexpectedEOF {
+			return 0, nil, nil
+		}
+		return 0, nil, errors.Wrap(errGo).With("file", rdr.fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	errGo = func() (errGo error) {
+		count := uint64(0)
+		if count, errGo = binary.ReadUvarint(rdr.in); errGo != nil {
+			return errGo
+		}
+		if count > recordingMaxChannels {
+			return errors.New("recording has too many channels in a frame").With("channels", count)
+		}
+		frame = make([]animationModel.ChannelData, 0, count)
+		for ; count != 0; count-- {
+			channel, errGo := binary.ReadUvarint(rdr.in)
+			if errGo != nil {
+				return errGo
+			}
+			pixels, errGo := binary.ReadUvarint(rdr.in)
+			if errGo != nil {
+				return errGo
+			}
+			if pixels > recordingMaxPixels {
+				return errors.New("recording has too many pixels in a channel").With("channel", channel).With("pixels", pixels)
+			}
+			rgb := make([]byte, 3*pixels)
+			if _, errGo = io.ReadFull(rdr.in, rgb); errGo != nil {
+				return errGo
+			}
+			data := make([]color.RGBA, pixels)
+			for i := range data {
+				data[i] = color.RGBA{R: rgb[i*3], G: rgb[i*3+1], B: rgb[i*3+2], A: 0xff}
+			}
+			frame = append(frame, animationModel.ChannelData{
+				ChannelNum: animationModel.OpcChannel(channel),
+				Data:       data,
+			})
+		}
+		return nil
+	}()
+
+	if errGo != nil {
+		if errGo == io.EOF || errGo == io.ErrUnexpectedEOF {
+			return 0, nil, nil
+		}
+		return 0, nil, errors.Wrap(errGo).With("file", rdr.fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return time.Duration(micros) * time.Microsecond, frame, nil
+}
+
+// Close releases the decompressor and the recording file
+//
+func (rdr *FrameReader) Close() {
+	rdr.zip.Close()
+	rdr.file.Close()
+}
@@ -0,0 +1,226 @@
+package mawt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+)
+
+// uvarints encodes the values as they are in a recording
+//
+func uvarints(values ...uint64) (encoded []byte) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, value := range values {
+		encoded = append(encoded, buf[:binary.PutUvarint(buf, value)]...)
+	}
+	return encoded
+}
+
+// writeRecording compresses the contents of a recording into the file
+//
+func writeRecording(t *testing.T, fn string, contents []byte) {
+	buf := &bytes.Buffer{}
+	zip := gzip.NewWriter(buf)
+	if _, errGo := zip.Write(contents); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo := zip.Close(); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo := ioutil.WriteFile(fn, buf.Bytes(), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+}
+
+// readRecording returns the uncompressed contents of a recording
+//
+func readRecording(t *testing.T, fn string) (contents []byte) {
+	file, errGo := os.Open(fn)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer file.Close()
+
+	zip, errGo := gzip.NewReader(file)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if contents, errGo = ioutil.ReadAll(zip); errGo != nil {
+		t.Fatal(errGo)
+	}
+	return contents
+}
+
+// readFrames returns the deltas and frames in a recording up to its end, or the
+// first error
+//
+func readFrames(t *testing.T, fn string) (deltas []time.Duration, frames [][]animationModel.ChannelData, err error) {
+	rdr, errOpen := OpenRecording(fn)
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	defer rdr.Close()
+
+	for {
+		delta, frame, errNext := rdr.Next()
+		if errNext != nil {
+			return deltas, frames, errNext
+		}
+		if frame == nil {
+			return deltas, frames, nil
+		}
+		deltas = append(deltas, delta)
+		frames = append(frames, frame)
+	}
+}
+
+// solid returns a channel with every pixel set to the color
+//
+func solid(channel int, pixels int, rgb color.RGBA) (data animationModel.ChannelData) {
+	data = animationModel.ChannelData{
+		ChannelNum: animationModel.OpcChannel(channel),
+		Data:       make([]color.RGBA, pixels),
+	}
+	for i := range data.Data {
+		data.Data[i] = rgb
+	}
+	return data
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "mawt-recording")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "frames.rec")
+
+	rec, err := NewFrameRecorder(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := rec.last
+
+	frames := [][]animationModel.ChannelData{
+		{solid(1, 3, color.RGBA{R: 10, G: 20, B: 30, A: 0xff})},
+		{solid(1, 2, color.RGBA{R: 1, A: 0xff}), solid(200, 40, color.RGBA{B: 0xff, A: 0xff})},
+		{},
+	}
+	times := []time.Time{
+		start.Add(10 * time.Millisecond),
+		start.Add(25 * time.Millisecond),
+		// A frame from before the previous frame is recorded at the same time
+		start.Add(20 * time.Millisecond),
+	}
+	for i, frame := range frames {
+		if err = rec.Record(times[i], frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The header is the magic and start time, followed by the first frame
+	// beginning with the microseconds since the start
+	header := append([]byte(recordingMagic), uvarints(uint64(start.UnixNano()))...)
+	header = append(header, uvarints(10000, 1, 1, 3)...)
+	if contents := readRecording(t, fn); !bytes.HasPrefix(contents, header) {
+		t.Fatalf("the recording began % x rather than % x", contents[:len(header)], header)
+	}
+
+	rdr, err := OpenRecording(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rdr.Start.Equal(start) {
+		t.Fatalf("the recording started at %v rather than %v", rdr.Start, start)
+	}
+	rdr.Close()
+
+	deltas, got, errNext := readFrames(t, fn)
+	if errNext != nil {
+		t.Fatal(errNext)
+	}
+	if expected := []time.Duration{10 * time.Millisecond, 15 * time.Millisecond, 0}; !reflect.DeepEqual(deltas, expected) {
+		t.Fatalf("the frames were %v apart rather than %v", deltas, expected)
+	}
+	if !reflect.DeepEqual(got, frames) {
+		t.Fatalf("read %v rather than the frames recorded", got)
+	}
+
+	// A recording whose last frame was cut short ends before that frame, whether
+	// it was cut within the header of the frame or within its pixels
+	contents := readRecording(t, fn)
+	for cut, expected := range map[int]int{1: 2, 5: 1} {
+		writeRecording(t, fn, contents[:len(contents)-cut])
+
+		if _, got, errNext = readFrames(t, fn); errNext != nil {
+			t.Fatal(errNext)
+		}
+		if !reflect.DeepEqual(got, frames[:expected]) {
+			t.Fatalf("read %d frames from the recording missing %d bytes rather than %d", len(got), cut, expected)
+		}
+	}
+}
+
+func TestRecordingDamaged(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "mawt-recording")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "frames.rec")
+
+	if errGo = ioutil.WriteFile(fn, []byte("not compressed"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, err := OpenRecording(fn); err == nil {
+		t.Fatal("a file that is not compressed was opened")
+	}
+
+	writeRecording(t, fn, []byte("MAWTREC0"))
+	if _, err := OpenRecording(fn); err == nil {
+		t.Fatal("a recording with the wrong magic was opened")
+	}
+
+	header := append([]byte(recordingMagic), uvarints(uint64(time.Now().UnixNano()))...)
+
+	// Frames too large to have been recorded are rejected before being allocated
+	damaged := map[string][]byte{
+		"channels": uvarints(1000, recordingMaxChannels+1),
+		"pixels":   uvarints(1000, 1, 0, recordingMaxPixels+1),
+	}
+	for limit, frame := range damaged {
+		writeRecording(t, fn, append(append([]byte{}, header...), frame...))
+		if _, _, err := readFrames(t, fn); err == nil {
+			t.Fatalf("a frame with too many %s was read", limit)
+		}
+	}
+
+	// Frames at the limits are accepted
+	frame := uvarints(1000, recordingMaxChannels)
+	for channel := 0; channel != recordingMaxChannels; channel++ {
+		frame = append(frame, uvarints(uint64(channel), 0)...)
+	}
+	frame = append(frame, uvarints(1000, 1, 0, recordingMaxPixels)...)
+	frame = append(frame, make([]byte, 3*recordingMaxPixels)...)
+
+	writeRecording(t, fn, append(header, frame...))
+	_, frames, err := readFrames(t, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || len(frames[0]) != recordingMaxChannels || len(frames[1][0].Data) != recordingMaxPixels {
+		t.Fatal("the frames at the limits were not read")
+	}
+}
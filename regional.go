@@ -0,0 +1,255 @@
+package mawt
+
+// This module shows the portals other than the home portal on the LEDs so that
+// the installation reflects the whole play area.  It is drawn over the frames
+// produced by the animation before they are sent.
+//
+// Each tecthulhu can be given a neighbor pixel that shows the faction of its
+// portal, green for the Enlightened, blue for the Resistance, and white for
+// a neutral portal, or a dim amber when the tecthulhu is offline.  Pixels
+// are named using the animation universe and the index of the pixel within
+// it, for example base1:29.  Giving one pixel on each of the resonator pads
+// forms a ring around the installation.
+//
+// When a portal other than the home portal changes faction the tower windows
+// can also be tinted with the color of the new faction, fading away over a
+// few seconds.
+
+import (
+	"image/color"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TeamNorCal/animation"
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// RegionalPixel names a single pixel within a universe drawn by the animation
+//
+type RegionalPixel struct {
+	Universe string
+	Pixel    int
+}
+
+// RegionalConfig contains the settings used to show the portals other than the home portal
+//
+type RegionalConfig struct {
+	Portals []string        // The tecthulhus, in the same order as the pixels
+	Pixels  []RegionalPixel // The neighbor pixel for each tecthulhu, none to disable
+
+	Accent      time.Duration // How long the tower is tinted after a remote capture, 0 to disable
+	AccentLevel float64       // The strength of the tint, 0.0 to 1.0
+}
+
+// DefaultRegionalConfig returns the settings used when none are supplied, which
+// do not show the other portals
+//
+func DefaultRegionalConfig() (cfg RegionalConfig) {
+	return RegionalConfig{
+		AccentLevel: 0.25,
+	}
+}
+
+// ParseRegionalPixels parses a comma separated list of universe:pixel values
+//
+func ParseRegionalPixels(spec string) (pixels []RegionalPixel, err errors.Error) {
+	pixels = []RegionalPixel{}
+	if len(strings.TrimSpace(spec)) == 0 {
+		return pixels, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 2 {
+			return nil, errors.New("neighbor pixels must be given as universe:pixel").With("pixel", item).With("stack", stack.Trace().TrimRuntime())
+		}
+		pixel, errGo := strconv.Atoi(parts[1])
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("pixel", item).With("stack", stack.Trace().TrimRuntime())
+		}
+		pixels = append(pixels, RegionalPixel{Universe: parts[0], Pixel: pixel})
+	}
+	return pixels, nil
+}
+
+var (
+	factionColors = map[string]color.RGBA{
+		"E": {R: 0x00, G: 0xff, B: 0x00, A: 0xff},
+		"R": {R: 0x00, G: 0x00, B: 0xff, A: 0xff},
+		"N": {R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+
+	offlineColor = color.RGBA{R: 76, G: 29, B: 0, A: 0xff}
+)
+
+// regionalUpdate carries a change in any of the portals to the renderer
+//
+type regionalUpdate struct {
+	url     string
+	home    bool
+	faction string // Empty for health changes
+	health  model.HealthState
+}
+
+// regionalPortal is what is known about one of the portals
+//
+type regionalPortal struct {
+	faction string
+	health  model.HealthState
+}
+
+// regionalOverlay draws the other portals onto frames, it is used only from within
+// the renderer goroutine
+//
+type regionalOverlay struct {
+	cfg       RegionalConfig
+	pixels    map[string]RegionalPixel // The neighbor pixel for each tecthulhu
+	portals   map[string]*regionalPortal
+	universes map[animationModel.OpcChannel]string // The universe drawn on each channel
+
+	accentColor color.RGBA
+	accentStart time.Time
+}
+
+// newRegionalOverlay checks that the neighbor pixels are present in the frames
+// drawn by the animation
+//
+func newRegionalOverlay(cfg RegionalConfig, sample []animationModel.ChannelData) (overlay *regionalOverlay, err errors.Error) {
+
+	if len(cfg.Pixels) > len(cfg.Portals) {
+		return nil, errors.New("there are more neighbor pixels than tecthulhus").With("pixels", len(cfg.Pixels)).With("tecthulhus", len(cfg.Portals)).With("stack", stack.Trace().TrimRuntime())
+	}
+	if cfg.Accent < 0 || cfg.AccentLevel < 0 || cfg.AccentLevel > 1 {
+		return nil, errors.New("the tower accent must be positive with a level from 0.0 to 1.0").With("accent", cfg.Accent).With("level", cfg.AccentLevel).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	overlay = &regionalOverlay{
+		cfg:       cfg,
+		pixels:    map[string]RegionalPixel{},
+		portals:   map[string]*regionalPortal{},
+		universes: map[animationModel.OpcChannel]string{},
+	}
+
+	sizes := map[string]int{}
+	for name, universe := range animation.Universes {
+		overlay.universes[animationModel.OpcChannel(universe.Index+1)] = name
+	}
+	for _, channel := range sample {
+		if name, isPresent := overlay.universes[channel.ChannelNum]; isPresent {
+			sizes[name] = len(channel.Data)
+		}
+	}
+
+	for i, pixel := range cfg.Pixels {
+		size, isPresent := sizes[pixel.Universe]
+		if !isPresent {
+			return nil, errors.New("neighbor pixel universe is not drawn by the animation").With("universe", pixel.Universe).With("stack", stack.Trace().TrimRuntime())
+		}
+		if pixel.Pixel < 0 || pixel.Pixel >= size {
+			return nil, errors.New("neighbor pixel is outside of its universe").With("universe", pixel.Universe).With("pixel", pixel.Pixel).With("size", size).With("stack", stack.Trace().TrimRuntime())
+		}
+		overlay.pixels[cfg.Portals[i]] = pixel
+	}
+	return overlay, nil
+}
+
+// update records a change in a portal, starting the tower accent when a portal other
+// than the home portal changes faction
+//
+func (overlay *regionalOverlay) update(update *regionalUpdate, now time.Time) {
+	portal, isPresent := overlay.portals[update.url]
+	if !isPresent {
+		portal = &regionalPortal{}
+		overlay.portals[update.url] = portal
+	}
+
+	if len(update.faction) == 0 {
+		portal.health = update.health
+		return
+	}
+
+	// The first status seen for a portal is not a change of faction
+	if len(portal.faction) != 0 && portal.faction != update.faction && !update.home && overlay.cfg.Accent > 0 {
+		overlay.accentColor = factionColors[update.faction]
+		overlay.accentStart = now
+	}
+	portal.faction = update.faction
+	portal.health = model.HealthOnline
+}
+
+// apply returns the frame with the other portals drawn over it, channels that are
+// changed are copied so that the buffers of the animation are left untouched
+//
+func (overlay *regionalOverlay) apply(tm time.Time, frame []animationModel.ChannelData) (result []animationModel.ChannelData) {
+
+	accent := 0.0
+	if overlay.cfg.Accent > 0 && !overlay.accentStart.IsZero() {
+		if elapsed := tm.Sub(overlay.accentStart); elapsed < overlay.cfg.Accent {
+			fade := 1.0 - float64(elapsed)/float64(overlay.cfg.Accent)
+			accent = overlay.cfg.AccentLevel * fade * fade
+		}
+	}
+
+	colors := map[string]map[int]color.RGBA{}
+	for url, pixel := range overlay.pixels {
+		portal, isPresent := overlay.portals[url]
+		if !isPresent {
+			continue
+		}
+		c := color.RGBA{}
+		switch {
+		case portal.health == model.HealthOffline:
+			c = offlineColor
+		case len(portal.faction) != 0:
+			c = factionColors[portal.faction]
+		default:
+			continue
+		}
+		if _, isPresent := colors[pixel.Universe]; !isPresent {
+			colors[pixel.Universe] = map[int]color.RGBA{}
+		}
+		colors[pixel.Universe][pixel.Pixel] = c
+	}
+
+	if len(colors) == 0 && accent == 0 {
+		return frame
+	}
+
+	result = make([]animationModel.ChannelData, len(frame))
+	copy(result, frame)
+
+	for i, channel := range result {
+		name := overlay.universes[channel.ChannelNum]
+		tower := accent != 0 && strings.HasPrefix(name, "towerLevel")
+		if !tower && len(colors[name]) == 0 {
+			continue
+		}
+
+		data := make([]color.RGBA, len(channel.Data))
+		copy(data, channel.Data)
+		if tower {
+			for p, c := range data {
+				data[p] = blendRGBA(c, overlay.accentColor, accent)
+			}
+		}
+		for p, c := range colors[name] {
+			data[p] = c
+		}
+		result[i].Data = data
+	}
+	return result
+}
+
+// blendRGBA mixes a fraction of the tint into a color
+//
+func blendRGBA(c color.RGBA, tint color.RGBA, level float64) (blended color.RGBA) {
+	r, g, b := toRGB(c)
+	mix := func(from uint8, to uint8) uint8 {
+		return uint8(float64(from)*(1.0-level) + float64(to)*level + 0.5)
+	}
+	return color.RGBA{R: mix(r, tint.R), G: mix(g, tint.G), B: mix(b, tint.B), A: 0xff}
+}
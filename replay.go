@@ -0,0 +1,122 @@
+package mawt
+
+// This module plays a recording of the frames drawn by the animation, see
+// recording.go, back to the LEDs.  Recordings are used for post-mortems of
+// events and to demonstrate the LEDs without a tecthulhu being present.
+
+import (
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// ReplayConfig contains the settings used to play a recording
+//
+type ReplayConfig struct {
+	File  string  // The recording to be played
+	Speed float64 // The rate at which the recording is played, 1.0 being the original speed
+	Loop  bool    // Play the recording repeatedly until stopped
+}
+
+// StartReplay sends the frames from a recording to the LEDs at the times they were
+// originally drawn, scaled by the replay speed.  The Done channel of the returned
+// FadeCandy is closed once the recording has been played, or after the quitC is
+// closed.
+//
+func StartReplay(leds LEDConfig, cfg ReplayConfig, errorC chan<- errors.Error, quitC <-chan struct{}) (fc *FadeCandy, err errors.Error) {
+
+	if cfg.Speed <= 0 {
+		return nil, errors.New("the replay speed must be greater than 0").With("speed", cfg.Speed).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	rdr, err := OpenRecording(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first frame is used to check the layout, and is then played as normal
+	delta, frame, err := rdr.Next()
+	if err != nil {
+		rdr.Close()
+		return nil, err
+	}
+	if frame == nil {
+		rdr.Close()
+		return nil, errors.New("the recording contains no frames").With("file", cfg.File).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if fc, err = newFadeCandy(leds, frame); err != nil {
+		rdr.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer close(fc.doneC)
+
+		err := errors.Error(nil)
+
+		if !fc.nop {
+			fc.router.run(errorC, quitC)
+		}
+
+		for {
+			if !fc.replay(rdr, delta, frame, cfg.Speed, leds.Debug, errorC, quitC) || !cfg.Loop {
+				rdr.Close()
+				return
+			}
+
+			// Start the recording again from the beginning
+			rdr.Close()
+			if rdr, err = OpenRecording(cfg.File); err != nil {
+				sendErr(errorC, err)
+				return
+			}
+			if delta, frame, err = rdr.Next(); err != nil || frame == nil {
+				if err != nil {
+					sendErr(errorC, err)
+				}
+				rdr.Close()
+				return
+			}
+		}
+	}()
+
+	return fc, nil
+}
+
+// replay plays the remainder of a recording starting with the frame already read
+// from it, false is returned if the replay was stopped before reaching the end
+//
+func (fc *FadeCandy) replay(rdr *FrameReader, delta time.Duration, frame []animationModel.ChannelData, speed float64,
+	debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) (completed bool) {
+
+	start := time.Now()
+	offset := time.Duration(0)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	for frame != nil {
+		offset += time.Duration(float64(delta) / speed)
+
+		timer.Reset(time.Until(start.Add(offset)))
+		select {
+		case <-timer.C:
+		case <-quitC:
+			return false
+		}
+
+		fc.show(time.Now(), frame, debug, errorC)
+
+		var err errors.Error
+		if delta, frame, err = rdr.Next(); err != nil {
+			sendErr(errorC, err)
+			return false
+		}
+	}
+	return true
+}
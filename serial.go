@@ -0,0 +1,250 @@
+package mawt
+
+// This module implements the serial line transport used by tecthulhu devices
+// that are cabled directly to the gateway, as opposed to those reached using
+// HTTP.  Devices are specified using URLs of the form
+// serial:///dev/ttyUSB0?baud=115200.
+//
+// The device emits JSON status documents on an unsolicited basis.  Documents
+// are framed by tracking the nesting of braces, rather than relying upon
+// line endings, so that any noise on the line between documents, or
+// documents truncated by a cable being pulled, can be skipped over.
+//
+// A device that stops sending while its USB adapter remains present is
+// detected by the age of the last document, once it is older than the
+// maximum age the device is treated as having failed.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	serialDefaultBaud = 115200
+
+	// The largest document that will be accepted from the device before
+	// the framer gives up and looks for the start of the next one
+	serialMaxFrame = 64 * 1024
+)
+
+// jsonFramer extracts complete top level JSON objects from a byte stream
+//
+type jsonFramer struct {
+	rdr *bufio.Reader
+}
+
+func newJSONFramer(rdr io.Reader) (framer *jsonFramer) {
+	return &jsonFramer{
+		rdr: bufio.NewReader(rdr),
+	}
+}
+
+// Next blocks until a complete JSON object has been read from the stream
+// and then returns it.  Any errors from the underlying reader are returned
+// unchanged.
+//
+func (framer *jsonFramer) Next() (frame []byte, errGo error) {
+
+	frame = make([]byte, 0, 4096)
+
+	depth := 0
+	inString := false
+	escaped := false
+
+	for {
+		c, errGo := framer.rdr.ReadByte()
+		if errGo != nil {
+			return nil, errGo
+		}
+
+		// Skip anything that appears between documents
+		if depth == 0 && c != '{' {
+			continue
+		}
+
+		frame = append(frame, c)
+
+		if len(frame) > serialMaxFrame {
+			frame = frame[:0]
+			depth = 0
+			inString = false
+			escaped = false
+			continue
+		}
+
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return frame, nil
+			}
+		}
+	}
+}
+
+// serialLink manages the connection to a serial tecthulhu and retains the most
+// recent status document that the device has sent
+//
+type serialLink struct {
+	device string
+	baud   int
+
+	latest   []byte
+	received time.Time     // When the latest document arrived
+	maxAge   time.Duration // How old the latest document can be before the device is considered silent
+	online   bool
+
+	sync.Mutex
+}
+
+func newSerialLink(u url.URL, maxAge time.Duration) (link *serialLink, err errors.Error) {
+
+	link = &serialLink{
+		device: u.Path,
+		baud:   serialDefaultBaud,
+		maxAge: maxAge,
+	}
+
+	if len(link.device) == 0 {
+		link.device = u.Opaque
+	}
+	if len(link.device) == 0 {
+		errGo := fmt.Errorf("serial tecthulhu URL is missing the device path")
+		return nil, errors.Wrap(errGo).With("url", u.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if baud := u.Query().Get("baud"); len(baud) != 0 {
+		rate, errGo := strconv.Atoi(baud)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("url", u.String()).With("stack", stack.Trace().TrimRuntime())
+		}
+		link.baud = rate
+	}
+
+	return link, nil
+}
+
+// status returns the last document received from the device, or an error if
+// the device is not currently connected or has stopped sending documents
+//
+func (link *serialLink) status() (body []byte, err errors.Error) {
+	link.Lock()
+	defer link.Unlock()
+
+	if !link.online {
+		return nil, errors.New("serial tecthulhu not connected").With("device", link.device).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(link.latest) == 0 {
+		return nil, errors.New("serial tecthulhu has not yet sent a status").With("device", link.device).With("stack", stack.Trace().TrimRuntime())
+	}
+	if age := time.Since(link.received); link.maxAge > 0 && age > link.maxAge {
+		return nil, errors.New("serial tecthulhu has stopped sending statuses").With("device", link.device).With("age", age.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	return append([]byte(nil), link.latest...), nil
+}
+
+// read consumes documents from an opened device until the device fails, or
+// is closed
+//
+func (link *serialLink) read(port io.Reader) (errGo error) {
+	framer := newJSONFramer(port)
+	for {
+		frame, errGo := framer.Next()
+		if errGo != nil {
+			return errGo
+		}
+		link.Lock()
+		link.latest = frame
+		link.received = time.Now()
+		link.Unlock()
+	}
+}
+
+// run opens the serial device and reads status documents from it.  When the
+// device is unplugged, or fails to open, the link will retry with an increasing
+// delay until it succeeds or the quitC is closed
+//
+func (link *serialLink) run(errorC chan<- errors.Error, quitC <-chan struct{}) {
+
+	minRetry := time.Duration(time.Second)
+	maxRetry := time.Duration(30 * time.Second)
+
+	retry := minRetry
+
+	for {
+		port, err := openSerial(link.device, link.baud)
+		if err == nil {
+			retry = minRetry
+
+			link.Lock()
+			link.online = true
+			link.Unlock()
+
+			// The port is closed when we are asked to stop, which will in turn
+			// unblock the reader
+			doneC := make(chan struct{})
+			go func() {
+				select {
+				case <-quitC:
+					port.Close()
+				case <-doneC:
+				}
+			}()
+
+			errGo := link.read(port)
+
+			close(doneC)
+			port.Close()
+
+			link.Lock()
+			link.online = false
+			link.latest = nil
+			link.Unlock()
+
+			select {
+			case <-quitC:
+				return
+			default:
+			}
+
+			if errGo == io.EOF {
+				err = errors.New("serial tecthulhu disconnected").With("device", link.device).With("stack", stack.Trace().TrimRuntime())
+			} else {
+				err = errors.Wrap(errGo).With("device", link.device).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+
+		sendErr(errorC, err)
+
+		select {
+		case <-time.After(retry):
+		case <-quitC:
+			return
+		}
+
+		if retry *= 2; retry > maxRetry {
+			retry = maxRetry
+		}
+	}
+}
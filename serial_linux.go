@@ -0,0 +1,74 @@
+package mawt
+
+// This file contains the Linux specific code needed to open and configure
+// a serial line, or a pseudo terminal standing in for one, that is attached
+// to a tecthulhu device
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	serialRates = map[int]uint32{
+		9600:   unix.B9600,
+		19200:  unix.B19200,
+		38400:  unix.B38400,
+		57600:  unix.B57600,
+		115200: unix.B115200,
+		230400: unix.B230400,
+		460800: unix.B460800,
+		921600: unix.B921600,
+	}
+)
+
+// openSerial opens the serial device and places it into raw 8N1 mode at the
+// requested baud rate.  The device is left in non blocking mode so that the
+// go runtime poller services reads and a Close will unblock any reader
+//
+func openSerial(device string, baud int) (port *os.File, err errors.Error) {
+
+	rate, isPresent := serialRates[baud]
+	if !isPresent {
+		errGo := fmt.Errorf("unsupported baud rate %d", baud)
+		return nil, errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	fd, errGo := unix.Open(device, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	tio, errGo := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if errGo != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Equivalent of cfmakeraw followed by the line speed being set
+	tio.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	tio.Oflag &^= unix.OPOST
+	tio.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	tio.Cflag &^= unix.CSIZE | unix.PARENB | unix.CBAUD
+	tio.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | rate
+	tio.Ispeed = rate
+	tio.Ospeed = rate
+	tio.Cc[unix.VMIN] = 1
+	tio.Cc[unix.VTIME] = 0
+
+	if errGo = unix.IoctlSetTermios(fd, unix.TCSETS, tio); errGo != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Discard anything that was sitting in the input queue prior to us opening the
+	// device as it is likely to be a partial document
+	unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIFLUSH)
+
+	return os.NewFile(uintptr(fd), device), nil
+}
@@ -0,0 +1,136 @@
+package mawt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/karlmutch/errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY creates a pseudo terminal pair, the master is written to by the test
+// standing in for a tecthulhu and the slave is opened by the serial link
+//
+func openPTY(t *testing.T) (master *os.File, slave string) {
+	master, errGo := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if errGo != nil {
+		t.Skip("pseudo terminals are not available", errGo)
+	}
+
+	unlock := int32(0)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, master.Fd(), unix.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		t.Fatal(errno)
+	}
+	pty, errGo := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if errGo != nil {
+		master.Close()
+		t.Fatal(errGo)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", pty)
+}
+
+// waitForFaction writes status documents to the master, surrounded by line noise, until
+// the link has framed and retained one that decodes with the expected faction
+//
+func waitForFaction(t *testing.T, link *serialLink, master *os.File, faction string) {
+	doc := fmt.Sprintf("\r\nOK\r\n{\"status\": {\"title\": \"a {brace} in a \\\"string\\\"\", \"level\": 3, \"controllingFaction\": %q, \"resonators\": []}}", faction)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, errGo := master.Write([]byte(doc)); errGo != nil {
+			t.Fatal(errGo)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		body, err := link.status()
+		if err != nil {
+			continue
+		}
+		status, err := decodeStatus(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Status.Faction == faction[:1] {
+			return
+		}
+	}
+	t.Fatalf("a status for the %s faction was not received", faction)
+}
+
+func TestSerialLinkPTY(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "mawt-serial")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	// The device is a symbolic link so that it can be pointed at a new pseudo
+	// terminal once the first has been closed, as happens when a cable is replugged
+	device := filepath.Join(dir, "tecthulhu")
+
+	master, slave := openPTY(t)
+	defer master.Close()
+	if errGo = os.Symlink(slave, device); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	u, errGo := url.Parse("serial://" + device + "?baud=115200")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	link, err := newSerialLink(*u, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.device != device || link.baud != 115200 {
+		t.Fatalf("unexpected device %s at %d baud", link.device, link.baud)
+	}
+
+	errorC := make(chan errors.Error, 10)
+	quitC := make(chan struct{})
+	defer close(quitC)
+
+	go link.run(errorC, quitC)
+
+	waitForFaction(t, link, master, "Enlightened")
+
+	// A device that goes quiet while still connected is not reported as
+	// holding its last status indefinitely
+	time.Sleep(link.maxAge + 100*time.Millisecond)
+	if _, err = link.status(); err == nil {
+		t.Fatal("a status was available after the device stopped sending")
+	}
+	waitForFaction(t, link, master, "Enlightened")
+
+	// Pulling the cable is reported and the status is no longer available
+	master.Close()
+	select {
+	case <-errorC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loss of the device was not reported")
+	}
+	if _, err = link.status(); err == nil {
+		t.Fatal("a status was available after the device was lost")
+	}
+
+	master, slave = openPTY(t)
+	defer master.Close()
+	if errGo = os.Remove(device); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = os.Symlink(slave, device); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	waitForFaction(t, link, master, "Resistance")
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package mawt
+
+// This file contains a placeholder for platforms on which the serial line
+// support for tecthulhu devices has not been implemented
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+func openSerial(device string, baud int) (port *os.File, err errors.Error) {
+	errGo := fmt.Errorf("serial tecthulhu devices are not supported on %s", runtime.GOOS)
+	return nil, errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+}
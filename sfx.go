@@ -5,6 +5,7 @@ package mawt
 // in turn queues up sounds effects to match.
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -22,9 +23,136 @@ type SFXState struct {
 	ambientC chan string
 	sfxC     chan []string
 
+	limiter *effectLimiter
+	player  *AudioPlayer // The audio output, see audio.go
+
 	sync.Mutex
 }
 
+const (
+	// The minimum time between repeats of the same resonator effect, this prevents
+	// a portal being wiped from queuing up the same effect for every resonator
+	resonatorEffectGap = time.Duration(2 * time.Second)
+)
+
+// effectLimiter is used to suppress an effect if it has been played recently
+type effectLimiter struct {
+	gap  time.Duration
+	last map[string]time.Time
+}
+
+func newEffectLimiter(gap time.Duration) (limiter *effectLimiter) {
+	return &effectLimiter{
+		gap:  gap,
+		last: map[string]time.Time{},
+	}
+}
+
+// allow returns true if the effect has not been allowed within the gap
+// prior to now, and records that the effect was allowed
+//
+func (limiter *effectLimiter) allow(effect string, now time.Time) bool {
+	if last, isPresent := limiter.last[effect]; isPresent && now.Sub(last) < limiter.gap {
+		return false
+	}
+	limiter.last[effect] = now
+	return true
+}
+
+// processEvent queues the sound effects for resonator events.  Effects are named
+// using the faction of the agent that owned the resonator, for example
+// e-resonator-deployed, or r-resonator-destroyed
+//
+func (sfx *SFXState) processEvent(evt *model.PortalEvent, now time.Time) (err errors.Error) {
+	if evt == nil {
+		return nil
+	}
+
+	faction := ""
+	action := ""
+
+	switch evt.Type {
+	case model.ResonatorDeployed:
+		faction = evt.After.Faction
+		action = "deployed"
+	case model.ResonatorDestroyed:
+		faction = evt.Before.Faction
+		action = "destroyed"
+	case model.ResonatorUpgraded:
+		faction = evt.After.Faction
+		action = "upgraded"
+	default:
+		return nil
+	}
+
+	// Neutral portals do not have resonators so there are no effects for them
+	if faction != "E" && faction != "R" {
+		return nil
+	}
+
+	effect := strings.ToLower(faction) + "-resonator-" + action
+
+	sfx.Lock()
+	allowed := sfx.limiter.allow(effect, now)
+	sfx.Unlock()
+
+	if !allowed {
+		return nil
+	}
+
+	go func() {
+		select {
+		case sfx.sfxC <- []string{effect}:
+		case <-time.After(time.Second):
+		}
+	}()
+
+	return nil
+}
+
+// processRemoteEvent queues the sound effects for the capture of a portal other than the
+// home portal, for example e-remote-capture
+//
+func (sfx *SFXState) processRemoteEvent(evt *model.PortalEvent, now time.Time) (err errors.Error) {
+	if evt == nil || evt.Type != model.FactionCaptured {
+		return nil
+	}
+	if evt.After.Faction != "E" && evt.After.Faction != "R" {
+		return nil
+	}
+
+	effect := strings.ToLower(evt.After.Faction) + "-remote-capture"
+
+	sfx.Lock()
+	allowed := sfx.limiter.allow(effect, now)
+	sfx.Unlock()
+
+	if !allowed {
+		return nil
+	}
+
+	go func() {
+		select {
+		case sfx.sfxC <- []string{effect}:
+		case <-time.After(time.Second):
+		}
+	}()
+
+	return nil
+}
+
+// homeChanged forgets the state of the previous home portal, the next status
+// then only establishes the ambient sound for the new home portal rather than
+// being played as a loss and capture
+//
+func (sfx *SFXState) homeChanged() {
+	sfx.Lock()
+	defer sfx.Unlock()
+
+	sfx.last = nil
+	sfx.current = nil
+}
+
 func (sfx *SFXState) process(msg *model.PortalMsg) (err errors.Error) {
 	if msg == nil {
 		return nil
@@ -63,9 +191,6 @@ func (sfx *SFXState) process(msg *model.PortalMsg) (err errors.Error) {
 		faction = strings.ToLower(state.Faction)
 		effect = faction + "-capture"
 		sfxs = append(sfxs, effect)
-	} else {
-		// If the new state was not a change of faction did the number
-		// of resonators change
 	}
 
 	if factionChange || forceAmbient {
@@ -100,28 +225,62 @@ func (sfx *SFXState) process(msg *model.PortalMsg) (err errors.Error) {
 	return nil
 }
 
-// StartSFX will add itself to the subscriptions for portal messages
-func StartSFX(subscribeC chan chan *model.PortalMsg, errorC chan<- errors.Error, quitC <-chan struct{}) {
+// StartSFX will add itself to the subscriptions for portal messages and then process
+// them in the background until the quitC is closed
+//
+func StartSFX(cfg AudioConfig, fanout *FanOut, errorC chan<- errors.Error, quitC <-chan struct{}) (sfx *SFXState) {
 
-	sfx := &SFXState{
+	sfx = &SFXState{
 		ambientC: make(chan string, 3),
 		sfxC:     make(chan []string, 3),
+		limiter:  newEffectLimiter(resonatorEffectGap),
 	}
 
-	if err := InitAudio(sfx.ambientC, sfx.sfxC, errorC, quitC); err != nil {
+	player, err := InitAudio(cfg, sfx.ambientC, sfx.sfxC, errorC, quitC)
+	if err != nil {
 		select {
 		case errorC <- err:
 		case <-time.After(100 * time.Millisecond):
-			fmt.Fprintf(os.Stderr, err.Error())
+			fmt.Fprintln(os.Stderr, err.Error())
 		}
 	}
+	sfx.player = player
+
+	// Subscribe to the home portal statuses, only the most recent status is of interest
+	// should they queue up.  Changes of the home portal are followed so that the status
+	// of the new home portal is not compared with the old one.
+	ctx, unsubscribe := context.WithCancel(context.Background())
 
-	// Allow a lot of messages to queue up as we will only process the last one anyway
-	updateC := make(chan *model.PortalMsg, 10)
-	defer close(updateC)
+	statusC := fanout.Subscribe(ctx, "sfx", Filter{Topics: []Topic{TopicStatus, TopicHome}, HomeOnly: true},
+		Queue{Size: 10, Policy: CoalesceLatest}).C
 
-	// Subscribe to portal events
-	subscribeC <- updateC
+	// The events have a queue of their own as a wiped and recaptured portal produces
+	// enough of them to otherwise push the status, and its capture sounds, out
+	eventsC := fanout.Subscribe(ctx, "sfx-events", Filter{Topics: []Topic{TopicEvents}, HomeOnly: true},
+		Queue{Size: 32, Policy: DropOldest}).C
+
+	// Captures of the other portals are listened to only when they have sounds, a nil
+	// channel being used otherwise as it is never ready
+	remoteC := (<-chan *Message)(nil)
+	if cfg.RemoteCaptures {
+		remoteC = fanout.Subscribe(ctx, "sfx-remote", Filter{Topics: []Topic{TopicEvents}}, Queue{Size: 10, Policy: DropOldest}).C
+	}
+
+	go func() {
+		defer unsubscribe()
+		sfx.run(statusC, eventsC, remoteC, errorC, quitC)
+	}()
+
+	return sfx
+}
+
+// Audio returns the audio output used for the sound effects
+//
+func (sfx *SFXState) Audio() (player *AudioPlayer) {
+	return sfx.player
+}
+
+func (sfx *SFXState) run(statusC <-chan *Message, eventsC <-chan *Message, remoteC <-chan *Message, errorC chan<- errors.Error, quitC <-chan struct{}) {
 
 	// Attempt to set the default audio effects
 	select {
@@ -132,25 +291,30 @@ func StartSFX(subscribeC chan chan *model.PortalMsg, errorC chan<- errors.Error,
 
 	// Now listen to the subscribed portal events
 	for {
-		lastMsg := &model.PortalMsg{}
-
 		select {
-		case msg := <-updateC:
-			// Only process the most recent portal status msg for the Home portal in
-			// the channel, if we are backed up
-			if msg.Home {
-				lastMsg = msg.DeepCopy()
+		case m := <-statusC:
+			if m.Topic == TopicHome {
+				sfx.homeChanged()
+				continue
 			}
 
-			if len(updateC) == 0 && lastMsg != nil {
-				if err := sfx.process(lastMsg); err != nil {
-					select {
-					case errorC <- err:
-					case <-time.After(20 * time.Millisecond):
-						fmt.Fprintf(os.Stderr, err.Error())
-					}
+			if err := sfx.process(m.Status.DeepCopy()); err != nil {
+				select {
+				case errorC <- err:
+				case <-time.After(20 * time.Millisecond):
+					fmt.Fprintln(os.Stderr, err.Error())
 				}
-				lastMsg = nil
+			}
+		case m := <-eventsC:
+			if err := sfx.processEvent(m.Event, time.Now()); err != nil {
+				sendErr(errorC, err)
+			}
+		case m := <-remoteC:
+			if m.Home {
+				continue
+			}
+			if err := sfx.processRemoteEvent(m.Event, time.Now()); err != nil {
+				sendErr(errorC, err)
 			}
 		case <-quitC:
 			return
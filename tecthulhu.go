@@ -4,9 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/TeamNorCal/mawt/model"
@@ -17,7 +21,9 @@ import (
 // This module implements a module to handle communications
 // with the tecthulhu device.  These devices can provide a WiFi
 // like capability, however the original documentation appears
-// to indicate a serial like communications peripheral
+// to indicate a serial like communications peripheral.  Both are
+// supported using http:// and serial:// URLs, the serial transport
+// being found in the serial.go file
 //
 // The following json shows example output from a tecthulhu used
 // for the 2018 season
@@ -133,54 +139,323 @@ type tStatus struct {
 	Resonators []tResonator `json:"resonators"`
 }
 
+// tPortalStatus is the envelope used by the 2018 season firmware
 type tPortalStatus struct {
-	State tStatus `json:"result"`
-	Code  string  `json:"code"`
+	State       tStatus         `json:"result"`
+	Message     *string         `json:"message"`
+	Code        string          `json:"code"`
+	FieldErrors json.RawMessage `json:"fieldErrors"`
+}
+
+var (
+	// ErrMalformedStatus is the cause of errors returned when a tecthulhu payload
+	// could not be converted into a valid canonical status
+	ErrMalformedStatus = errors.New("malformed tecthulhu status")
+
+	// ErrDeviceStatus is the cause of errors returned when a tecthulhu has indicated
+	// using its result code, or field errors, that the status it sent is not usable
+	ErrDeviceStatus = errors.New("tecthulhu reported an error")
+
+	// compassPoints are the positions at which resonators can be deployed
+	compassPoints = map[string]bool{
+		"N": true, "NE": true, "E": true, "SE": true,
+		"S": true, "SW": true, "W": true, "NW": true,
+	}
+)
+
+const (
+	maxLevel  = 8
+	maxHealth = 100
+)
+
+// check examines the envelope for any errors that the device has reported
+//
+func (tec *tPortalStatus) check() (err errors.Error) {
+
+	fieldErrors := strings.TrimSpace(string(tec.FieldErrors))
+	hasFieldErrors := len(fieldErrors) != 0 && fieldErrors != "null" && fieldErrors != "[]" && fieldErrors != "{}"
+
+	if (len(tec.Code) == 0 || tec.Code == "OK") && !hasFieldErrors {
+		return nil
+	}
+
+	err = errors.Wrap(ErrDeviceStatus).With("code", tec.Code)
+	if tec.Message != nil {
+		err = err.With("message", *tec.Message)
+	}
+	if hasFieldErrors {
+		err = err.With("fieldErrors", fieldErrors)
+	}
+	return err.With("stack", stack.Trace().TrimRuntime())
+}
+
+// tStatusEnvelope is the envelope used by the earlier firmware, and the
+// scenarios bundled with the simulator, which has no result code and uses
+// numeric faction identifiers, for example
+//
+//{
+//    "status": {
+//        "title": "Camp Navarro",
+//        "owner": "",
+//        "level": 1,
+//        "health": 20,
+//        "controllingFaction": "1",
+//        "mods": [],
+//        "resonators": [ ... ]
+//    }
+//}
+//
+type tStatusEnvelope struct {
+	State tStatus `json:"status"`
+}
+
+// StatusDecoder is implemented by types that understand a specific generation of
+// the tecthulhu firmware output.  Sniff is given the top level members of the
+// JSON document received from the device and should return true if the decoder
+// understands the payload, Decode then performs the conversion into the
+// canonical portal status
+//
+type StatusDecoder interface {
+	Sniff(doc map[string]json.RawMessage) (isMatch bool)
+	Decode(body []byte) (status *model.PortalStatus, err errors.Error)
+}
+
+type namedDecoder struct {
+	name    string
+	decoder StatusDecoder
+}
+
+var (
+	decoders = struct {
+		list []namedDecoder
+		sync.Mutex
+	}{
+		list: []namedDecoder{
+			{name: "result", decoder: &resultDecoder{}},
+			{name: "status", decoder: &statusDecoder{}},
+		},
+	}
+)
+
+// RegisterDecoder adds a decoder for a tecthulhu payload format.  Decoders are
+// consulted in the order they were registered, with the built in formats
+// being checked first.  Registering a decoder using an existing name will
+// replace the existing decoder.
+//
+func RegisterDecoder(name string, decoder StatusDecoder) {
+	decoders.Lock()
+	defer decoders.Unlock()
+
+	for i, existing := range decoders.list {
+		if existing.name == name {
+			decoders.list[i].decoder = decoder
+			return
+		}
+	}
+	decoders.list = append(decoders.list, namedDecoder{name: name, decoder: decoder})
+}
+
+// decodeStatus sniffs the payload received from a tecthulhu and uses the first
+// decoder that recognizes it to produce the canonical status
+//
+func decodeStatus(body []byte) (status *model.PortalStatus, err errors.Error) {
+	doc := map[string]json.RawMessage{}
+	if errGo := json.Unmarshal(body, &doc); errGo != nil {
+		return nil, errors.Wrap(errGo).With("body", string(body)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	decoders.Lock()
+	list := decoders.list
+	decoders.Unlock()
+
+	for _, candidate := range list {
+		if candidate.decoder.Sniff(doc) {
+			if status, err = candidate.decoder.Decode(body); err != nil {
+				return nil, err.With("decoder", candidate.name)
+			}
+			return status, nil
+		}
+	}
+
+	return nil, errors.New("unrecognized tecthulhu payload").With("body", string(body)).With("stack", stack.Trace().TrimRuntime())
+}
+
+type resultDecoder struct{}
+
+func (*resultDecoder) Sniff(doc map[string]json.RawMessage) (isMatch bool) {
+	_, isMatch = doc["result"]
+	return isMatch
+}
+
+func (*resultDecoder) Decode(body []byte) (status *model.PortalStatus, err errors.Error) {
+	tecStatus := &tPortalStatus{}
+	if errGo := json.Unmarshal(body, tecStatus); errGo != nil {
+		return nil, errors.Wrap(errGo).With("body", string(body)).With("stack", stack.Trace().TrimRuntime())
+	}
+	if err = tecStatus.check(); err != nil {
+		return nil, err
+	}
+	return tecStatus.State.status()
+}
+
+type statusDecoder struct{}
+
+func (*statusDecoder) Sniff(doc map[string]json.RawMessage) (isMatch bool) {
+	_, isMatch = doc["status"]
+	return isMatch
+}
+
+func (*statusDecoder) Decode(body []byte) (status *model.PortalStatus, err errors.Error) {
+	tecStatus := &tStatusEnvelope{}
+	if errGo := json.Unmarshal(body, tecStatus); errGo != nil {
+		return nil, errors.Wrap(errGo).With("body", string(body)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return tecStatus.State.status()
+}
+
+// FactionCode maps the faction identifiers used by the various firmware generations,
+// be they numeric, abbreviated, or long form, into the single letter codes used
+// by the canonical status
+//
+func FactionCode(faction string) (code string, isKnown bool) {
+	switch strings.ToLower(strings.TrimSpace(faction)) {
+	case "0", "n", "neu", "neutral", "none":
+		return "N", true
+	case "1", "e", "enl", "enlightened":
+		return "E", true
+	case "2", "r", "res", "resistance":
+		return "R", true
+	}
+	return "", false
 }
 
 type PortalMon interface {
 	Run(quitC <-chan struct{})
 }
 
+// PollConfig controls how often a tecthulhu is checked for changes to the
+// portal state, and how the checks back off when the device is unreachable
+//
+type PollConfig struct {
+	Interval   time.Duration // The regular delay between status checks
+	Fast       time.Duration // The delay between checks used while the portal is changing
+	FastWindow time.Duration // How long after the last detected change the fast delay is used
+	Timeout    time.Duration // The maximum time a single status check may take
+	MaxBackoff time.Duration // The upper limit for the delay while a device is unreachable
+	Jitter     float64       // The fraction of each delay that is randomized, 0.0 to 1.0
+
+	OfflineAfter time.Duration // How long without a good status before a device is considered offline
+}
+
+// DefaultPollConfig returns the polling settings used when none are supplied
+//
+func DefaultPollConfig() (cfg PollConfig) {
+	return PollConfig{
+		Interval:   time.Duration(5 * time.Second),
+		Fast:       time.Duration(time.Second),
+		FastWindow: time.Duration(30 * time.Second),
+		Timeout:    time.Duration(3 * time.Second),
+		MaxBackoff: time.Duration(time.Minute),
+		Jitter:     0.1,
+
+		OfflineAfter: time.Duration(30 * time.Second),
+	}
+}
+
 type tecthulhu struct {
-	url     url.URL
-	home    bool
-	statusC chan<- *model.PortalMsg
-	errorC  chan<- errors.Error
+	url    url.URL
+	fanout *FanOut
+	errorC chan<- errors.Error
+
+	poll   PollConfig
+	client *http.Client
+	health *portalHealth
+
+	last       *model.Status // The last status that was successfully retrieved
+	seq        uint64        // The number of times the status has been seen to change
+	lastChange time.Time     // When the portal status was last seen to change
+	failures   int           // The number of consecutive failed status checks
+
+	serial *serialLink // Populated by Run for serial:// devices
 }
 
-func NewTecthulu(url url.URL, home bool, statusC chan<- *model.PortalMsg, errorC chan<- errors.Error) (tec *tecthulhu) {
+func NewTecthulu(url url.URL, poll PollConfig, fanout *FanOut, errorC chan<- errors.Error) (tec *tecthulhu) {
 	return &tecthulhu{
-		url:     url,
-		home:    home,
-		statusC: statusC,
-		errorC:  errorC,
+		url:    url,
+		fanout: fanout,
+		errorC: errorC,
+		poll:   poll,
+		client: &http.Client{
+			Timeout: poll.Timeout,
+		},
+		health: newPortalHealth(url.String(), poll.OfflineAfter, time.Now()),
+	}
+}
+
+// clamp limits a level or health reading to the range the canonical model expects
+//
+func clamp(value int, max int) float32 {
+	if value < 0 {
+		return 0
+	}
+	if value > max {
+		return float32(max)
 	}
+	return float32(value)
 }
 
-func (tec *tPortalStatus) status() (state *model.PortalStatus) {
+// status validates the device specific status and converts it into the canonical
+// portal status.  Errors returned by this function will have ErrMalformedStatus
+// as their cause.  Values outside of their valid ranges are clamped rather than
+// rejected as some firmware has been seen to overshoot
+//
+func (tec *tStatus) status() (state *model.PortalStatus, err errors.Error) {
+
+	if len(strings.TrimSpace(tec.Faction)) == 0 {
+		return nil, errors.Wrap(ErrMalformedStatus, "missing controllingFaction").With("stack", stack.Trace().TrimRuntime())
+	}
+	faction, isKnown := FactionCode(tec.Faction)
+	if !isKnown {
+		return nil, errors.Wrap(ErrMalformedStatus, "unknown controllingFaction").With("faction", tec.Faction).With("stack", stack.Trace().TrimRuntime())
+	}
+
 	state = &model.PortalStatus{
 		Status: model.Status{
-			Title:      tec.State.Title,
-			Owner:      tec.State.Owner,
-			Level:      float32(tec.State.Level),
-			Health:     float32(tec.State.Health),
-			Faction:    tec.State.Faction,
+			Title:      tec.Title,
+			Owner:      tec.Owner,
+			Level:      clamp(tec.Level, maxLevel),
+			Health:     clamp(tec.Health, maxHealth),
+			Faction:    faction,
 			Mods:       []model.Mod{},
 			Resonators: []model.Resonator{},
 		},
 	}
-	for _, res := range tec.State.Resonators {
+
+	// Some scenarios repeat the resonator list, identical repeats are ignored
+	// while conflicting resonators in the same position are rejected
+	seen := map[string]tResonator{}
+	for _, res := range tec.Resonators {
+		position := strings.ToUpper(strings.TrimSpace(res.Position))
+		if !compassPoints[position] {
+			return nil, errors.Wrap(ErrMalformedStatus, "unknown resonator position").With("position", res.Position).With("stack", stack.Trace().TrimRuntime())
+		}
+		if previous, isPresent := seen[position]; isPresent {
+			if previous == res {
+				continue
+			}
+			return nil, errors.Wrap(ErrMalformedStatus, "conflicting resonators in the same position").With("position", res.Position).With("stack", stack.Trace().TrimRuntime())
+		}
+		seen[position] = res
+
 		state.Status.Resonators = append(state.Status.Resonators,
 			model.Resonator{
-				Position: res.Position,
-				Level:    float32(res.Level),
-				Health:   float32(res.Health),
+				Position: position,
+				Level:    clamp(res.Level, maxLevel),
+				Health:   clamp(res.Health, maxHealth),
 				Owner:    res.Owner,
 			})
 	}
-	state.Status.Faction = string(tec.State.Faction[0])
-	for _, mod := range tec.State.Mods {
+	for _, mod := range tec.Mods {
 		newMod := model.Mod{
 			Slot:   float32(mod.Slot),
 			Type:   mod.Type,
@@ -189,7 +464,7 @@ func (tec *tPortalStatus) status() (state *model.PortalStatus) {
 		}
 		state.Status.Mods = append(state.Status.Mods, newMod)
 	}
-	return state
+	return state, nil
 }
 
 // checkPortal can be used to extract status information from the portal
@@ -200,7 +475,7 @@ func (tec *tecthulhu) checkPortal() (status *model.PortalStatus, err errors.Erro
 
 	switch tec.url.Scheme {
 	case "http":
-		resp, errGo := http.Get(tec.url.String())
+		resp, errGo := tec.client.Get(tec.url.String())
 		if errGo != nil {
 			return nil, errors.Wrap(errGo).With("url", tec.url).With("stack", stack.Trace().TrimRuntime())
 		}
@@ -212,8 +487,12 @@ func (tec *tecthulhu) checkPortal() (status *model.PortalStatus, err errors.Erro
 		}
 
 	case "serial":
-		errGo := fmt.Errorf("Unknown scheme %s for the tecthulhu device is not yet implemented", tec.url.Scheme)
-		return nil, errors.Wrap(errGo).With("url", tec.url).With("stack", stack.Trace().TrimRuntime())
+		if tec.serial == nil {
+			return nil, errors.New("serial tecthulhu not started").With("url", tec.url).With("stack", stack.Trace().TrimRuntime())
+		}
+		if body, err = tec.serial.status(); err != nil {
+			return nil, err.With("url", tec.url)
+		}
 
 	default:
 		errGo := fmt.Errorf("Unknown scheme %s for the tecthulhu device URI", tec.url.Scheme)
@@ -224,17 +503,13 @@ func (tec *tecthulhu) checkPortal() (status *model.PortalStatus, err errors.Erro
 	// the canonical format used by the concentrator which we assume
 	// is a reference format for portal data and meta data
 	//
-	tecStatus := &tPortalStatus{}
-
-	errGo := json.Unmarshal(body, &tecStatus)
-	if errGo != nil {
-		return nil, errors.Wrap(errGo).With("url", tec.url).With("body", string(body)).With("stack", stack.Trace().TrimRuntime())
+	if status, err = decodeStatus(body); err != nil {
+		return nil, err.With("url", tec.url)
 	}
-	status = tecStatus.status()
-	return status, err
+	return status, nil
 }
 
-func (tec *tecthulhu) sendStatus() {
+func (tec *tecthulhu) sendStatus() (changed bool, err errors.Error) {
 	// Perform a regular status check with the portal
 	// and return the received results  to listeners using
 	// the channel
@@ -250,26 +525,87 @@ func (tec *tecthulhu) sendStatus() {
 				fmt.Fprintf(os.Stderr, "could not send error for portal status update %s\n", err.Error())
 			}
 		}(err)
-		return
+		tec.published(tec.fanout.PublishError(tec.url.String(), err))
+		return false, err
 	}
 
-	msg := &model.PortalMsg{
+	changed = tec.last == nil || !reflect.DeepEqual(*tec.last, status.Status)
+
+	events := []*model.PortalEvent{}
+	if changed {
+		events = model.Diff(tec.url.String(), tec.last, &status.Status, time.Now())
+	}
+	tec.last = &status.Status
+	if changed {
+		tec.seq++
+	}
+
+	tec.published(tec.fanout.PublishStatus(&model.PortalMsg{
+		URL:    tec.url.String(),
+		Seq:    tec.seq,
 		Status: status.Status,
-		Home:   tec.home,
+	}))
+
+	// Semantic events follow the status that they were derived from
+	for _, event := range events {
+		tec.published(tec.fanout.PublishEvent(event))
 	}
+	return changed, nil
+}
 
-	select {
-	case tec.statusC <- msg:
-	case <-time.After(750 * time.Millisecond):
-		go func() {
-			err := errors.New("portal status dropped").With("url", tec.url).With("stack", stack.Trace().TrimRuntime())
-			select {
-			case tec.errorC <- err:
-			case <-time.After(2 * time.Second):
-				fmt.Fprintf(os.Stderr, "could not send error for portal status update %s\n", err.Error())
-			}
-		}()
+// published reports a message that the fan-out could not accept in a timely fashion
+//
+func (tec *tecthulhu) published(err errors.Error) {
+	if err == nil {
+		return
 	}
+	go func() {
+		select {
+		case tec.errorC <- err:
+		case <-time.After(2 * time.Second):
+			fmt.Fprintf(os.Stderr, "could not send error for portal status update %s\n", err.Error())
+		}
+	}()
+}
+
+// nextPoll uses the outcome of the last status check to decide how long to wait
+// before the next one.  Unreachable devices are checked with an exponentially
+// increasing delay, portals that have recently changed state are checked more
+// frequently as this is typically when a battle is taking place
+//
+func (tec *tecthulhu) nextPoll(now time.Time, changed bool, err errors.Error) (delay time.Duration) {
+
+	delay = tec.poll.Interval
+
+	switch {
+	case err != nil:
+		tec.failures++
+		for i := 1; i < tec.failures && delay < tec.poll.MaxBackoff; i++ {
+			delay *= 2
+		}
+		if delay > tec.poll.MaxBackoff {
+			delay = tec.poll.MaxBackoff
+		}
+	default:
+		tec.failures = 0
+		if changed {
+			tec.lastChange = now
+		}
+		if now.Sub(tec.lastChange) < tec.poll.FastWindow && tec.poll.Fast < delay {
+			delay = tec.poll.Fast
+		}
+	}
+
+	// Spread the checks out so that several devices being polled do not stay in
+	// lock step with each other
+	if tec.poll.Jitter > 0 {
+		spread := float64(delay) * tec.poll.Jitter
+		delay += time.Duration(spread * (2*rand.Float64() - 1))
+	}
+	if delay <= 0 {
+		delay = time.Duration(100 * time.Millisecond)
+	}
+	return delay
 }
 
 // startPortal listens to a tecthulhu device and returns
@@ -278,12 +614,33 @@ func (tec *tecthulhu) sendStatus() {
 //
 func (tec *tecthulhu) Run(quitC <-chan struct{}) {
 
-	refresh := time.Duration(5 * time.Second)
+	if tec.url.Scheme == "serial" {
+		// A device that is silent for as long as it takes to be considered offline
+		// is treated as having failed, even if it remains plugged in
+		link, err := newSerialLink(tec.url, tec.poll.OfflineAfter)
+		if err != nil {
+			sendErr(tec.errorC, err)
+			return
+		}
+		tec.serial = link
+		go link.run(tec.errorC, quitC)
+	}
+
+	// Let listeners know the device is being connected to
+	tec.published(tec.fanout.PublishHealth(tec.health.current()))
+
+	// Check immediately on startup, rather than waiting for a full interval
+	refresh := time.Duration(0)
 
 	for {
 		select {
 		case <-time.After(refresh):
-			tec.sendStatus()
+			changed, err := tec.sendStatus()
+			now := time.Now()
+			if msg := tec.health.update(now, err); msg != nil {
+				tec.published(tec.fanout.PublishHealth(msg))
+			}
+			refresh = tec.nextPoll(now, changed, err)
 		case <-quitC:
 			return
 		}
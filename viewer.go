@@ -0,0 +1,415 @@
+package mawt
+
+// This module implements a browser based viewer for the LED frames.  A page
+// served at /leds/, by the mawt command on the debugging listener, draws a
+// schematic of the 8 resonator pads surrounding the 16 tower windows, and is
+// sent the live frames from the animation over a WebSocket at /leds/ws.  This
+// allows animations to be developed without any LEDs attached.
+//
+// The WebSocket support is a minimal implementation of RFC 6455 covering the
+// server side of the handshake, unfragmented frames, ping, and close.
+//
+// When a client connects it is sent a text message containing a JSON array
+// describing each universe, its name, OPC channel, and pixel count.  Frames
+// are then sent as binary messages holding the RGB values for each universe,
+// 3 bytes per pixel, in the order of the description.
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TeamNorCal/animation"
+	animationModel "github.com/TeamNorCal/animation/model"
+)
+
+const (
+	// The maximum rate at which frames are sent to browsers
+	viewerFPS = 20
+
+	// How long a browser has to accept a frame before it is disconnected
+	viewerWriteTimeout = time.Duration(2 * time.Second)
+
+	// The largest message accepted from a browser, which only sends control messages
+	viewerMaxRead = 4096
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsText   = 0x1
+	wsBinary = 0x2
+	wsClose  = 0x8
+	wsPing   = 0x9
+	wsPong   = 0xA
+)
+
+type viewerUniverse struct {
+	Name    string `json:"name"`
+	Channel int    `json:"channel"`
+	Size    int    `json:"size"`
+}
+
+// frameViewer tracks the browsers watching the LEDs and sends them frames
+//
+type frameViewer struct {
+	clients map[*viewerClient]bool
+	last    time.Time
+	sync.Mutex
+}
+
+// viewerClient is a single browser connection
+//
+type viewerClient struct {
+	conn   net.Conn
+	frameC chan []byte // Holds the next frame, frames are replaced if the browser falls behind
+	doneC  chan struct{}
+	once   sync.Once
+
+	sync.Mutex // Serializes writes to the connection
+}
+
+func newFrameViewer() (fv *frameViewer) {
+	return &frameViewer{
+		clients: map[*viewerClient]bool{},
+	}
+}
+
+// universes describes the universes drawn by the animation in channel order
+//
+func viewerUniverses() (universes []viewerUniverse) {
+	universes = make([]viewerUniverse, 0, len(animation.Universes))
+	for name, universe := range animation.Universes {
+		universes = append(universes, viewerUniverse{
+			Name:    name,
+			Channel: universe.Index + 1,
+			Size:    universe.Size,
+		})
+	}
+	sort.Slice(universes, func(i, j int) bool { return universes[i].Channel < universes[j].Channel })
+	return universes
+}
+
+// watching is used by the renderer to avoid doing any work when there are no browsers
+//
+func (fv *frameViewer) watching() (isWatched bool) {
+	fv.Lock()
+	defer fv.Unlock()
+	return len(fv.clients) != 0
+}
+
+// publish sends a frame to every browser, frames arriving faster than the viewer
+// rate are skipped
+//
+func (fv *frameViewer) publish(tm time.Time, frame []animationModel.ChannelData) {
+	fv.Lock()
+	defer fv.Unlock()
+
+	if len(fv.clients) == 0 || tm.Sub(fv.last) < time.Second/viewerFPS {
+		return
+	}
+	fv.last = tm
+
+	sorted := make([]animationModel.ChannelData, len(frame))
+	copy(sorted, frame)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ChannelNum < sorted[j].ChannelNum })
+
+	data := []byte{}
+	for _, channel := range sorted {
+		for _, pixel := range channel.Data {
+			r, g, b := toRGB(pixel)
+			data = append(data, r, g, b)
+		}
+	}
+
+	for client := range fv.clients {
+		// Replace any frame the browser has not yet taken
+		select {
+		case <-client.frameC:
+		default:
+		}
+		client.frameC <- data
+	}
+}
+
+func (fv *frameViewer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/leds/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, viewerPage)
+	case "/leds/ws":
+		fv.serveWebSocket(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// headerContains checks for a token within a comma separated header
+//
+func headerContains(r *http.Request, name string, token string) (isPresent bool) {
+	for _, value := range r.Header[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (fv *frameViewer) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerContains(r, "Connection", "upgrade") ||
+		!headerContains(r, "Upgrade", "websocket") || len(key) == 0 {
+		http.Error(w, "a WebSocket upgrade is required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	hijacker, isHijacker := w.(http.Hijacker)
+	if !isHijacker {
+		http.Error(w, "WebSockets are not supported by this server", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, errGo := hijacker.Hijack()
+	if errGo != nil {
+		return
+	}
+
+	hash := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(hash[:]))
+	if errGo = rw.Flush(); errGo != nil {
+		conn.Close()
+		return
+	}
+
+	client := &viewerClient{
+		conn:   conn,
+		frameC: make(chan []byte, 1),
+		doneC:  make(chan struct{}),
+	}
+
+	description, _ := json.Marshal(viewerUniverses())
+	if errGo = client.write(wsText, description); errGo != nil {
+		client.close()
+		return
+	}
+
+	fv.Lock()
+	fv.clients[client] = true
+	fv.Unlock()
+
+	go client.read(rw.Reader)
+
+	// Frames are sent until the browser goes away
+	for {
+		select {
+		case data := <-client.frameC:
+			if errGo = client.write(wsBinary, data); errGo != nil {
+				client.close()
+			}
+		case <-client.doneC:
+			fv.Lock()
+			delete(fv.clients, client)
+			fv.Unlock()
+			return
+		}
+	}
+}
+
+func (client *viewerClient) close() {
+	client.once.Do(func() {
+		close(client.doneC)
+		client.conn.Close()
+	})
+}
+
+// write sends a single unfragmented message, server messages are not masked
+//
+func (client *viewerClient) write(opcode byte, payload []byte) (errGo error) {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	client.Lock()
+	defer client.Unlock()
+
+	client.conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+	if _, errGo = client.conn.Write(append(header, payload...)); errGo != nil {
+		return errGo
+	}
+	return nil
+}
+
+// read consumes messages from the browser, answering pings and closing the connection
+// when asked to or when the browser sends anything invalid
+//
+func (client *viewerClient) read(rdr *bufio.Reader) {
+	defer client.close()
+
+	for {
+		header := make([]byte, 2)
+		if _, errGo := io.ReadFull(rdr, header); errGo != nil {
+			return
+		}
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7f)
+
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, errGo := io.ReadFull(rdr, ext); errGo != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, errGo := io.ReadFull(rdr, ext); errGo != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
+
+		// Browsers must mask what they send, and have no reason to send much
+		if !masked || length > viewerMaxRead {
+			return
+		}
+
+		mask := make([]byte, 4)
+		if _, errGo := io.ReadFull(rdr, mask); errGo != nil {
+			return
+		}
+		payload := make([]byte, length)
+		if _, errGo := io.ReadFull(rdr, payload); errGo != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsClose:
+			client.write(wsClose, payload)
+			return
+		case wsPing:
+			if errGo := client.write(wsPong, payload); errGo != nil {
+				return
+			}
+		}
+	}
+}
+
+// viewerPage draws the resonator pads, with N at the top, around the tower which
+// has level 1 at the bottom
+const viewerPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mawt LEDs</title>
+<style>
+body { background: #111; color: #ccc; font-family: sans-serif; margin: 0; }
+#status { position: absolute; top: 8px; left: 8px; font-size: 12px; }
+canvas { display: block; margin: 0 auto; }
+</style>
+</head>
+<body>
+<div id="status">connecting</div>
+<canvas id="leds" width="720" height="720"></canvas>
+<script>
+var canvas = document.getElementById("leds");
+var ctx = canvas.getContext("2d");
+var statusText = document.getElementById("status");
+var universes = [];
+var compass = ["N", "NE", "E", "SE", "S", "SW", "W", "NW"];
+
+// Returns the center of each pixel of a universe
+function positions(u) {
+	var points = [];
+	var m = u.name.match(/^base(\d+)$/);
+	if (m) {
+		var angle = (parseInt(m[1]) - 1) * Math.PI / 4;
+		var cx = 360 + 280 * Math.sin(angle), cy = 360 - 280 * Math.cos(angle);
+		for (var i = 0; i < u.size; i++) {
+			var a = 2 * Math.PI * i / u.size;
+			points.push([cx + 45 * Math.sin(a), cy - 45 * Math.cos(a)]);
+		}
+		return points;
+	}
+	m = u.name.match(/^towerLevel(\d+)Window(\d+)$/);
+	if (m) {
+		var level = parseInt(m[1]), win = parseInt(m[2]);
+		var x = 300 + (win - 1) * 66, y = 600 - level * 60;
+		for (var i = 0; i < u.size; i++) {
+			points.push([x + (i % 5) * 12, y + Math.floor(i / 5) * 9]);
+		}
+	}
+	return points;
+}
+
+function label(u, points) {
+	var m = u.name.match(/^base(\d+)$/);
+	if (m && points.length) {
+		var angle = (parseInt(m[1]) - 1) * Math.PI / 4;
+		ctx.fillStyle = "#666";
+		ctx.fillText(compass[parseInt(m[1]) - 1], 360 + 350 * Math.sin(angle) - 6, 360 - 345 * Math.cos(angle) + 4);
+	}
+}
+
+function connect() {
+	var ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/leds/ws");
+	ws.binaryType = "arraybuffer";
+	ws.onopen = function() { statusText.textContent = "connected"; };
+	ws.onclose = function() { statusText.textContent = "disconnected, retrying"; setTimeout(connect, 2000); };
+	ws.onmessage = function(msg) {
+		if (typeof msg.data === "string") {
+			universes = JSON.parse(msg.data);
+			universes.forEach(function(u) { u.points = positions(u); });
+			return;
+		}
+		var rgb = new Uint8Array(msg.data);
+		var offset = 0;
+		ctx.fillStyle = "#111";
+		ctx.fillRect(0, 0, canvas.width, canvas.height);
+		universes.forEach(function(u) {
+			label(u, u.points);
+			for (var i = 0; i < u.size; i++, offset += 3) {
+				if (i >= u.points.length) {
+					continue;
+				}
+				ctx.fillStyle = "rgb(" + rgb[offset] + "," + rgb[offset + 1] + "," + rgb[offset + 2] + ")";
+				ctx.fillRect(u.points[i][0] - 4, u.points[i][1] - 3, 8, 6);
+			}
+		});
+	};
+}
+connect();
+</script>
+</body>
+</html>
+`